@@ -1,17 +1,33 @@
 package app
 
-import "dsh/px/db"
+import (
+	"context"
+	"fmt"
+	"time"
 
-// NewContext creates and returns [Context] for appID
-func (self *Global) NewContext(appID string) (*Context, error) {
-	db, err := self.db.DB(appID)
-	if err != nil {
-		return nil, err
+	"dsh/px/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// NewContext creates and returns [Context] for appID. It doesn't touch DB of
+// this app, the DB is acquired on first usage. Returned [Context] should be
+// closed by [Context.Close] at the end of the request. If appID isn't known
+// app, it returns [Error] of kind [ErrNotFound].
+//
+// ctx is context of the request. We stop waiting for DB of this app, when it's
+// done.
+func (self *Global) NewContext(ctx context.Context, appID string) (*Context, error) {
+	if !self.registry.Has(appID) {
+		return nil, NewError(ErrNotFound,
+			fmt.Sprintf("app %q not found", appID), nil)
 	}
 
 	return &Context{
-		appID: appID,
-		db:    db,
+		appID:  appID,
+		reqCtx: ctx,
+		dbMgr:  self.db,
+		rwPin:  self.rwPin,
 	}, nil
 }
 
@@ -21,12 +37,123 @@ func (self *Global) NewContext(appID string) (*Context, error) {
 type Context struct {
 	// ID of application this context for. Also we use it as DB name for this app.
 	appID string
+	// Context of the request
+	reqCtx context.Context
+
+	// Manager of DB pools. We acquire lease from it on first usage and release
+	// it on Close.
+	dbMgr *db.Mgr
 
-	// DB pools, initialized to connect to DB with name appID.
-	db *db.DB
+	// Lease of DB pools, initialized to connect to DB with name appID. It's nil
+	// until somebody asked for it.
+	lease *db.Lease
+
+	// How long RO returns RW pool after a write. Zero means RO never does it.
+	rwPin time.Duration
+	// RO returns RW pool until this time
+	rwPinUntil time.Time
+	// Called when RO starts returning RW pool after a write
+	onPinRW func(until time.Time)
 }
 
 // AppID returns ID of app this [Context] was created for
 func (self *Context) AppID() string {
 	return self.appID
 }
+
+// DB returns DB pools of this app and error if any or nil. It acquires them
+// from the manager on first call and returns the same [db.DB] after that. The
+// error is [Error], see [dbError].
+func (self *Context) DB() (*db.DB, error) {
+	if self.lease == nil {
+		lease, err := self.dbMgr.DBContext(self.reqCtx, self.appID)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		self.lease = lease
+	}
+	return self.lease.DB(), nil
+}
+
+// RW returns [*sqlx.DB] pool of connections to read-write server of this app
+// and error if any or nil. We consider every call of RW as a write, so RO
+// returns the same pool after that for a while, if it was configured.
+func (self *Context) RW() (*sqlx.DB, error) {
+	db, err := self.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	if self.rwPin > 0 {
+		self.rwPinUntil = time.Now().Add(self.rwPin)
+		if self.onPinRW != nil {
+			self.onPinRW(self.rwPinUntil)
+		}
+	}
+
+	return db.RW(), nil
+}
+
+// RO returns [*sqlx.DB] pool of connections to read-only replica of this app
+// and error if any or nil. If the app hasn't replica or reads are pinned to
+// read-write server after a write, it returns pool of read-write server.
+func (self *Context) RO() (*sqlx.DB, error) {
+	db, err := self.DB()
+	if err != nil {
+		return nil, err
+	}
+	if self.PinnedRW() {
+		return db.RW(), nil
+	} else if ro := db.RO(); ro != nil {
+		return ro, nil
+	}
+	return db.RW(), nil
+}
+
+// ReportRO reports err returned by ro pool, which we've got from RO, so we can
+// stop reading from failed replica. It returns err as is. See [db.DB.ReportRO]
+// for details.
+func (self *Context) ReportRO(ro *sqlx.DB, err error) error {
+	if self.lease == nil {
+		return err
+	}
+	return self.lease.DB().ReportRO(ro, err)
+}
+
+// PinRW pins reads to read-write server until given time, so RO returns pool
+// of read-write server. We use it for continuing the pinning from previous
+// requests of the same client. until is limited by configured pinning window.
+func (self *Context) PinRW(until time.Time) {
+	if self.rwPin <= 0 {
+		return
+	}
+	if max := time.Now().Add(self.rwPin); until.After(max) {
+		until = max
+	}
+	if until.After(self.rwPinUntil) {
+		self.rwPinUntil = until
+	}
+}
+
+// PinnedRW returns true if reads are pinned to read-write server at this
+// moment.
+func (self *Context) PinnedRW() bool {
+	return time.Now().Before(self.rwPinUntil)
+}
+
+// OnPinRW sets fn, which will be called every time a write pins reads to
+// read-write server. until is time until reads are pinned. We use it for
+// saving the pinning for next requests of the same client.
+func (self *Context) OnPinRW(fn func(until time.Time)) {
+	self.onPinRW = fn
+}
+
+// Close releases everything this [Context] acquired during the request. It
+// releases lease of DB, if it was acquired, so DB can be put into idle list and
+// closed later. It's safe to call Close more than once.
+func (self *Context) Close() {
+	if self.lease != nil {
+		self.lease.Release()
+		self.lease = nil
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dsh/px/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := new(Global)
+	ctx, err := g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+	require.NotNil(ctx)
+	assert.Equal(ctx.AppID(), "demoa")
+	assert.Nil(ctx.lease, "DB acquired before usage")
+
+	ctx.Close()
+}
+
+func TestNewContextUnknownApp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	registry, err := NewRegistry("", "demoa")
+	require.NoError(err)
+	g := &Global{registry: registry}
+
+	ctx, err := g.NewContext(context.Background(), "demob")
+	assert.ErrorIs(err, ErrNotFound)
+	assert.Nil(ctx)
+
+	ctx, err = g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+	assert.NotNil(ctx)
+}
+
+func TestContextDB(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := &Global{
+		db: db.NewMgr(db.Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}),
+	}
+	ctx, err := g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+
+	rw, err := ctx.RW()
+	require.NoError(err)
+	assert.NotNil(rw)
+	require.NotNil(ctx.lease)
+
+	ro, err := ctx.RO()
+	require.NoError(err)
+	assert.Same(ro, rw, "RO without replica should be RW")
+
+	db, err := ctx.DB()
+	require.NoError(err)
+	assert.Same(db, ctx.lease.DB())
+
+	ctx.Close()
+	assert.Nil(ctx.lease)
+	ctx.Close()
+}
+
+func TestContextPinRW(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := &Global{
+		db: db.NewMgr(db.Config{
+			Driver: "mysql",
+			HostRW: "tcp(127.0.0.1)",
+			HostRO: []string{"tcp(127.0.0.2)"},
+		}),
+		rwPin: time.Minute,
+	}
+	ctx, err := g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+	defer ctx.Close()
+
+	var pinnedUntil time.Time
+	ctx.OnPinRW(func(until time.Time) { pinnedUntil = until })
+
+	ro, err := ctx.RO()
+	require.NoError(err)
+	assert.False(ctx.PinnedRW())
+	assert.True(pinnedUntil.IsZero())
+
+	rw, err := ctx.RW()
+	require.NoError(err)
+	assert.NotSame(ro, rw)
+	assert.True(ctx.PinnedRW())
+	assert.WithinDuration(pinnedUntil, time.Now().Add(time.Minute), time.Second)
+
+	ro, err = ctx.RO()
+	require.NoError(err)
+	assert.Same(ro, rw)
+}
+
+func TestContextPinRWLimit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := new(Global)
+	ctx, err := g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+	ctx.PinRW(time.Now().Add(time.Minute))
+	assert.False(ctx.PinnedRW(), "pinned without pinning window")
+
+	g.rwPin = time.Minute
+	ctx, err = g.NewContext(context.Background(), "demoa")
+	require.NoError(err)
+	ctx.PinRW(time.Now().Add(time.Hour))
+	assert.True(ctx.PinnedRW())
+	assert.WithinDuration(ctx.rwPinUntil, time.Now().Add(time.Minute),
+		time.Second)
+
+	ctx.PinRW(time.Now().Add(-time.Minute))
+	assert.True(ctx.PinnedRW())
+}
@@ -1,7 +1,16 @@
 package app
 
 import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/joho/godotenv"
+
+	"dsh/px/db"
 )
 
 // LoadDotEnv reads .env files and loads their content into env variables. It
@@ -25,3 +34,186 @@ func LoadDotEnv(env string) {
 	godotenv.Load(".env." + env)
 	godotenv.Load() // load .env
 }
+
+// durationEnv returns value of env variable name parsed by
+// [time.ParseDuration]. Empty variable means zero duration. Also it returns
+// error if any or nil.
+func durationEnv(name string) (time.Duration, error) {
+	d, err := parseDuration(os.Getenv(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// parseDuration parses s by [time.ParseDuration] and returns it. Empty s means
+// zero duration and negative durations are invalid. Also it returns error if
+// any or nil.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	} else if d < 0 {
+		return 0, fmt.Errorf("negative duration %v", d)
+	}
+	return d, nil
+}
+
+// poolEnvFields contains names of fields of [db.PoolConfig] in env variables.
+var poolEnvFields = [...]string{
+	"MAX_OPEN_CONNS", "MAX_IDLE_CONNS", "CONN_MAX_LIFETIME", "CONN_MAX_IDLE_TIME",
+}
+
+// poolConfigFromEnv returns [db.PoolConfig] from env variables like
+//
+//   <prefix>MAX_OPEN_CONNS
+//
+// for every field in poolEnvFields. Also it returns error if any or nil.
+func poolConfigFromEnv(prefix string) (db.PoolConfig, error) {
+	var pool db.PoolConfig
+	for _, field := range poolEnvFields {
+		name := prefix + field
+		if _, err := setPoolField(&pool, field, os.Getenv(name)); err != nil {
+			return pool, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return pool, nil
+}
+
+// setPoolField parses value and sets it to field of pool. field is one of
+// poolEnvFields. Empty value means zero. It returns false if field is unknown.
+// Also it returns error if any or nil.
+func setPoolField(pool *db.PoolConfig, field, value string) (bool, error) {
+	var err error
+	switch field {
+	case "MAX_OPEN_CONNS":
+		pool.MaxOpenConns, err = parseInt(value)
+	case "MAX_IDLE_CONNS":
+		pool.MaxIdleConns, err = parseInt(value)
+	case "CONN_MAX_LIFETIME":
+		pool.ConnMaxLifetime, err = parseDuration(value)
+	case "CONN_MAX_IDLE_TIME":
+		pool.ConnMaxIdleTime, err = parseDuration(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// parseInt parses s as decimal integer and returns it. Empty s means zero.
+// Also it returns error if any or nil.
+func parseInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// parseBool parses s by [strconv.ParseBool] and returns it. Empty s means
+// false. Also it returns error if any or nil.
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// dbAppEnvPrefix is prefix of env variables with per app DB overrides, like
+//
+//   DB_APP_DEMOA_HOST_RW
+const dbAppEnvPrefix = "DB_APP_"
+
+// parseDBParams parses params of DB driver in URL query format, like
+// "charset=utf8mb4&parseTime=true", and returns them as a map. Returns nil map
+// for empty s. Also it returns error if any or nil.
+func parseDBParams(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse DB params %q: %w", s, err)
+	}
+
+	params := make(map[string]string, len(values))
+	for k := range values {
+		params[k] = values.Get(k)
+	}
+	return params, nil
+}
+
+// dbAppsFromEnv returns per app DB overrides from env variables environ in
+// format of [os.Environ]. Every override is defined by env variable like
+//
+//   DB_APP_<APPID>_<FIELD>
+//
+// where APPID is upper cased appID and FIELD is one of USER, PASS, HOST_RW,
+// HOST_RO, PARAMS or IDLE_TTL. HOST_RO is a list of hosts separated by commas.
+// Also FIELD can be one of poolEnvFields with prefix RW_ or RO_, like
+// RW_MAX_OPEN_CONNS.
+// Returns nil map if there are no overrides. Also it returns error if any or
+// nil.
+func dbAppsFromEnv(environ []string) (map[string]db.AppConfig, error) {
+	var apps map[string]db.AppConfig
+	for _, kv := range environ {
+		name, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, dbAppEnvPrefix) {
+			continue
+		}
+
+		appID, field, ok := strings.Cut(
+			strings.TrimPrefix(name, dbAppEnvPrefix), "_")
+		if !ok || appID == "" {
+			continue
+		}
+		appID = strings.ToLower(appID)
+
+		if apps == nil {
+			apps = make(map[string]db.AppConfig)
+		}
+		app := apps[appID]
+		switch field {
+		case "USER":
+			app.User = v
+		case "PASS":
+			app.Pass = v
+		case "HOST_RW":
+			app.HostRW = v
+		case "HOST_RO":
+			app.HostRO = strings.FieldsFunc(v, isListSep)
+		case "PARAMS":
+			params, err := parseDBParams(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			app.Params = params
+		case "IDLE_TTL":
+			ttl, err := parseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			app.IdleTTL = ttl
+		default:
+			pool := &app.RWPool
+			if strings.HasPrefix(field, "RO_") {
+				pool = &app.ROPool
+			} else if !strings.HasPrefix(field, "RW_") {
+				continue
+			}
+			ok, err := setPoolField(pool, field[len("RW_"):], v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			} else if !ok {
+				continue
+			}
+		}
+		apps[appID] = app
+	}
+
+	return apps, nil
+}
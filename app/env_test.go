@@ -0,0 +1,124 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"dsh/px/db"
+)
+
+func TestParseDBParams(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	params, err := parseDBParams("")
+	require.NoError(err)
+	assert.Nil(params)
+
+	params, err = parseDBParams("charset=utf8mb4&parseTime=true")
+	require.NoError(err)
+	assert.Equal(params,
+		map[string]string{"charset": "utf8mb4", "parseTime": "true"})
+
+	_, err = parseDBParams("charset=%zz")
+	assert.Error(err)
+}
+
+func TestDBAppsFromEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	apps, err := dbAppsFromEnv([]string{"DB_USER=user", "HOME=/root"})
+	require.NoError(err)
+	assert.Nil(apps)
+
+	apps, err = dbAppsFromEnv([]string{
+		"DB_USER=user",
+		"DB_APP_DEMOA_USER=usera",
+		"DB_APP_DEMOA_PASS=pass=a",
+		"DB_APP_DEMOA_HOST_RW=tcp(db1)",
+		"DB_APP_DEMOA_HOST_RO=tcp(db2),tcp(db3)",
+		"DB_APP_DEMOB1_PARAMS=charset=latin1",
+		"DB_APP_DEMOB1_UNKNOWN=something",
+		"DB_APP_DEMOB1_RW_UNKNOWN=something",
+		"DB_APP_DEMOB1_RW_MAX_OPEN_CONNS=10",
+		"DB_APP_DEMOB1_RO_CONN_MAX_IDLE_TIME=1m",
+		"DB_APP_DEMOB1_IDLE_TTL=10m",
+	})
+	require.NoError(err)
+	assert.Equal(apps, map[string]db.AppConfig{
+		"demoa": {
+			User:   "usera",
+			Pass:   "pass=a",
+			HostRW: "tcp(db1)",
+			HostRO: []string{"tcp(db2)", "tcp(db3)"},
+		},
+		"demob1": {
+			Params:  map[string]string{"charset": "latin1"},
+			RWPool:  db.PoolConfig{MaxOpenConns: 10},
+			ROPool:  db.PoolConfig{ConnMaxIdleTime: time.Minute},
+			IdleTTL: 10 * time.Minute,
+		},
+	})
+
+	_, err = dbAppsFromEnv([]string{"DB_APP_DEMOA_PARAMS=a=%zz"})
+	assert.ErrorContains(err, "DB_APP_DEMOA_PARAMS")
+
+	_, err = dbAppsFromEnv([]string{"DB_APP_DEMOA_RO_MAX_IDLE_CONNS=many"})
+	assert.ErrorContains(err, "DB_APP_DEMOA_RO_MAX_IDLE_CONNS")
+
+	_, err = dbAppsFromEnv([]string{"DB_APP_DEMOA_IDLE_TTL=-1m"})
+	assert.ErrorContains(err, "DB_APP_DEMOA_IDLE_TTL")
+}
+
+func TestPoolConfigFromEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pool, err := poolConfigFromEnv("PX_TEST_")
+	require.NoError(err)
+	assert.Zero(pool)
+
+	t.Setenv("PX_TEST_MAX_OPEN_CONNS", "20")
+	t.Setenv("PX_TEST_MAX_IDLE_CONNS", "-1")
+	t.Setenv("PX_TEST_CONN_MAX_LIFETIME", "5m")
+	t.Setenv("PX_TEST_CONN_MAX_IDLE_TIME", "30s")
+	pool, err = poolConfigFromEnv("PX_TEST_")
+	require.NoError(err)
+	assert.Equal(pool, db.PoolConfig{
+		MaxOpenConns:    20,
+		MaxIdleConns:    -1,
+		ConnMaxLifetime: 5 * time.Minute,
+		ConnMaxIdleTime: 30 * time.Second,
+	})
+
+	t.Setenv("PX_TEST_CONN_MAX_LIFETIME", "forever")
+	_, err = poolConfigFromEnv("PX_TEST_")
+	assert.ErrorContains(err, "PX_TEST_CONN_MAX_LIFETIME")
+}
+
+func TestDurationEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	t.Setenv("PX_TEST_DURATION", "")
+	d, err := durationEnv("PX_TEST_DURATION")
+	require.NoError(err)
+	assert.Zero(d)
+
+	t.Setenv("PX_TEST_DURATION", "1m30s")
+	d, err = durationEnv("PX_TEST_DURATION")
+	require.NoError(err)
+	assert.Equal(d, 90*time.Second)
+
+	t.Setenv("PX_TEST_DURATION", "-1s")
+	_, err = durationEnv("PX_TEST_DURATION")
+	assert.Error(err)
+
+	t.Setenv("PX_TEST_DURATION", "soon")
+	_, err = durationEnv("PX_TEST_DURATION")
+	assert.ErrorContains(err, "PX_TEST_DURATION")
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"dsh/px/db"
+)
+
+// Kinds of errors, which can happen during processing of a request. Every
+// [Error] has one of them as its Kind and can be checked with [errors.Is], like
+//
+//   errors.Is(err, app.ErrNotFound)
+var (
+	// Requested app or something inside of it doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// DB or other service we depend on isn't available at this moment.
+	ErrUnavailable = errors.New("service unavailable")
+	// Request is malformed or has invalid params.
+	ErrBadRequest = errors.New("bad request")
+	// Processing of the request took too much time.
+	ErrTimeout = errors.New("timeout")
+	// Client canceled the request, e.g. closed its connection, before we
+	// processed it.
+	ErrCanceled = errors.New("canceled")
+)
+
+// NewError creates and returns [Error] of kind. detail describes this
+// occurrence of error and err is an underlying error, which may be nil.
+func NewError(kind error, detail string, err error) *Error {
+	return &Error{Kind: kind, Detail: detail, Err: err}
+}
+
+// Error defines an error, which happened during processing of a request.
+type Error struct {
+	// Kind of this error, one of ErrNotFound, ErrUnavailable, ...
+	Kind error
+	// Human readable explanation specific to this occurrence of the error. It's
+	// safe to show it to a client.
+	Detail string
+	// Underlying error, if any. It isn't shown to a client.
+	Err error
+}
+
+// Error returns text of this error, combined from Kind, Detail and Err.
+func (self *Error) Error() string {
+	s := self.Kind.Error()
+	if self.Detail != "" {
+		s += ": " + self.Detail
+	}
+	if self.Err != nil {
+		s += ": " + self.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns underlying error or nil.
+func (self *Error) Unwrap() error {
+	return self.Err
+}
+
+// Is returns true if target is Kind of this error. It makes [errors.Is] works
+// with kinds of errors.
+func (self *Error) Is(target error) bool {
+	return target == self.Kind
+}
+
+// dbError converts err returned by [db.Mgr] into [Error] of kind
+// [ErrUnavailable], [ErrNotFound] if database of the app doesn't exist,
+// [ErrTimeout] if we didn't get DB in time, or [ErrCanceled] if context of the
+// request was canceled while we waited for DB.
+func dbError(err error) *Error {
+	if errors.Is(err, db.ErrOverloaded) {
+		return NewError(ErrUnavailable, "too many apps at this moment", err)
+	} else if errors.Is(err, db.ErrUnknownDB) {
+		return NewError(ErrNotFound, "database of app not found", err)
+	} else if errors.Is(err, db.ErrTooManyConns) {
+		return NewError(ErrUnavailable, "database is overloaded", err)
+	} else if errors.Is(err, db.ErrUnreachable) {
+		return NewError(ErrUnavailable, "database isn't available", err)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return NewError(ErrTimeout, "timeout while waiting for database", err)
+	} else if errors.Is(err, context.Canceled) {
+		return NewError(ErrCanceled, "request canceled", err)
+	}
+	return NewError(ErrUnavailable, "database isn't available", err)
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"dsh/px/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	assert := assert.New(t)
+
+	cause := errors.New("connection refused")
+	err := error(NewError(ErrUnavailable, "database isn't available", cause))
+	assert.True(errors.Is(err, ErrUnavailable))
+	assert.False(errors.Is(err, ErrNotFound))
+	assert.True(errors.Is(err, cause))
+	assert.Equal(err.Error(),
+		"service unavailable: database isn't available: connection refused")
+
+	err = NewError(ErrNotFound, "", nil)
+	assert.Equal(err.Error(), "not found")
+	assert.Nil(errors.Unwrap(err))
+}
+
+func TestDBError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := dbError(db.ErrOverloaded)
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.ErrorIs(err, db.ErrOverloaded)
+	assert.Equal(err.Detail, "too many apps at this moment")
+
+	err = dbError(&db.ConnError{Kind: db.ErrUnknownDB})
+	assert.ErrorIs(err, ErrNotFound)
+	assert.ErrorIs(err, db.ErrUnknownDB)
+
+	err = dbError(&db.ConnError{Kind: db.ErrTooManyConns})
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.Equal(err.Detail, "database is overloaded")
+
+	err = dbError(&db.ConnError{
+		Kind: db.ErrUnreachable,
+		Err:  context.DeadlineExceeded,
+	})
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.NotErrorIs(err, ErrTimeout)
+
+	err = dbError(context.DeadlineExceeded)
+	assert.ErrorIs(err, ErrTimeout)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	err = dbError(context.Canceled)
+	assert.ErrorIs(err, ErrCanceled)
+	assert.ErrorIs(err, context.Canceled)
+
+	err = dbError(errors.New("connection refused"))
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.Equal(err.Detail, "database isn't available")
+}
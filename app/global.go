@@ -5,35 +5,270 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"dsh/px/db"
 )
 
-// New creates instance of [Global] and returns it. Expects next env variables:
+// New creates instance of [Global] and returns it. Also it returns error if
+// any or nil. Expects next env variables:
 //
 //   * DB_DRIVER:  name of database driver ("mysql", "pgx", ...)
 //   * DB_USER:    connection username
 //   * DB_PASS:    connection password
-//   * DB_HOST_RW: [protocol[(address)]] for main (RW) connection
+//   * DB_HOST_RW: [protocol[(address)]] for main (RW) connection. For "pgx"
+//                 it can be "host:port" too.
 //   * DB_HOST_RO:
 //
-//     Same for optional replica connection. Shoul be empty string if not used.
-func New() *Global {
+//     Same for optional replica connections, separated by commas. Shoul be
+//     empty string if not used.
+//
+//   * DB_RO_BALANCE: how to select replica, "round-robin" (default) or
+//                    "least-in-flight"
+//   * DB_RO_MAX_LAG: optional max replication lag of replica, like "5s"
+//   * DB_RW_PIN:     optional duration, how long reads of a client go to RW
+//                    server after a write, like "10s"
+//   * DB_PARAMS:     optional params of DB driver, like "charset=utf8mb4"
+//
+// Options of RW pool, all of them are optional:
+//
+//   * DB_RW_MAX_OPEN_CONNS:     max number of open connections
+//   * DB_RW_MAX_IDLE_CONNS:     max number of idle connections
+//   * DB_RW_CONN_MAX_LIFETIME:  max time a connection may be reused ("3m")
+//   * DB_RW_CONN_MAX_IDLE_TIME: max time a connection may be idle
+//
+// and the same options of every RO pool: DB_RO_MAX_OPEN_CONNS, ...
+//
+//   * DB_MAX_CONNS: optional global budget of connections of all pools of all
+//                   apps. It's divided among open pools equally.
+//   * DB_MAX_IDLE_APPS: optional max number of idle apps with open pools. The
+//                       least recently used ones are closed, when we have
+//                       more.
+//   * DB_IDLE_TTL: optional duration, how long pools of idle app are kept
+//                  open ("5m")
+//   * DB_IDLE_INTERVAL: optional min interval between checks of expired idle
+//                       apps ("1s")
+//   * DB_IDLE_JITTER: optional max random duration added to DB_IDLE_INTERVAL
+//                     ("5s"). "0" disables it.
+//   * DB_ACQUIRE_TIMEOUT: optional max duration a request waits for DB of its
+//                         app ("10s")
+//   * DB_PING_TIMEOUT: optional max duration of checking connection to every
+//                      server, when pools of an app are opened ("2s"). If
+//                      it's empty, connections aren't checked.
+//   * DB_FAILURE_BACKOFF: optional duration, how long requests of an app get
+//                         the same error without retry, after we failed to
+//                         open its pools ("1s"). It's doubled after every
+//                         failure in a row.
+//   * DB_FAILURE_MAX_BACKOFF: optional max value of DB_FAILURE_BACKOFF ("30s")
+//   * DB_LEASE_DEBUG: optional debug mode of DB leases ("true"). In this mode we
+//                     record who acquires DB of an app, log warnings about DB
+//                     held too long and return outstanding leases by
+//                     [Global.DBLeases]. They are served on admin endpoints
+//                     only, but they contain stack traces, so don't enable it
+//                     on instances, which admin endpoints are reachable from
+//                     internet.
+//   * DB_LEASE_WARN_AFTER: optional duration of holding DB, after which we log
+//                          a warning in debug mode ("30s")
+//   * DB_SHARDS: optional number of shards of active apps (32). Every shard has
+//                its own lock.
+//   * DB_WARM_APPS: optional list of apps, separated by commas, which pools are
+//                   opened on startup by [Global.WarmUp]
+//   * DB_SNAPSHOT_FILE: optional file, where last use time and request rate of
+//                       active and idle apps are saved periodically and on
+//                       shutdown. On next start hot apps from it are warmed
+//                       up too and keep their LRU order.
+//   * DB_SNAPSHOT_INTERVAL: optional interval of saving DB_SNAPSHOT_FILE ("1m")
+//   * DB_WARM_CONNS: optional number of ready connections of every pool after
+//                    warm-up (1)
+//
+// Every app can override DB_USER, DB_PASS, DB_HOST_RW, DB_HOST_RO, DB_PARAMS,
+// DB_IDLE_TTL and options of pools by env variables like DB_APP_DEMOA_HOST_RW
+// or DB_APP_DEMOA_RW_MAX_OPEN_CONNS, where DEMOA is upper cased appID.
+// DB_APP_*_PARAMS are merged with DB_PARAMS.
+//
+//   * APP_IDS:           optional list of known apps, separated by commas
+//   * APP_REGISTRY_FILE: optional file with list of known apps, one per line
+//
+// If APP_IDS and APP_REGISTRY_FILE are empty, every app is known.
+//
+// DB options are validated here, so New returns error on startup, if something
+// is wrong with them.
+func New() (*Global, error) {
+	dbParams, err := parseDBParams(os.Getenv("DB_PARAMS"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_PARAMS: %w", err)
+	}
+
+	dbApps, err := dbAppsFromEnv(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
 	dbConfig := db.Config{
 		Driver: os.Getenv("DB_DRIVER"),
 		User:   os.Getenv("DB_USER"),
 		Pass:   os.Getenv("DB_PASS"),
 		HostRW: os.Getenv("DB_HOST_RW"),
-		HostRO: os.Getenv("DB_HOST_RO"),
+		HostRO: strings.FieldsFunc(os.Getenv("DB_HOST_RO"), isListSep),
+
+		ROBalance: os.Getenv("DB_RO_BALANCE"),
+		Params:    dbParams,
+		Apps:      dbApps,
+
+		WarmApps: strings.FieldsFunc(os.Getenv("DB_WARM_APPS"), isListSep),
+
+		SnapshotFile: os.Getenv("DB_SNAPSHOT_FILE"),
 	}
-	return &Global{
-		db: db.NewMgr(dbConfig),
+
+	if dbConfig.ROMaxLag, err = durationEnv("DB_RO_MAX_LAG"); err != nil {
+		return nil, err
+	}
+	if dbConfig.RWPool, err = poolConfigFromEnv("DB_RW_"); err != nil {
+		return nil, err
+	}
+	if dbConfig.ROPool, err = poolConfigFromEnv("DB_RO_"); err != nil {
+		return nil, err
+	}
+	if dbConfig.MaxConns, err = parseInt(os.Getenv("DB_MAX_CONNS")); err != nil {
+		return nil, fmt.Errorf("DB_MAX_CONNS: %w", err)
+	}
+	dbConfig.MaxIdleDBs, err = parseInt(os.Getenv("DB_MAX_IDLE_APPS"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_MAX_IDLE_APPS: %w", err)
+	}
+	if dbConfig.IdleTTL, err = durationEnv("DB_IDLE_TTL"); err != nil {
+		return nil, err
+	}
+	if dbConfig.IdleInterval, err = durationEnv("DB_IDLE_INTERVAL"); err != nil {
+		return nil, err
+	}
+	if dbConfig.IdleJitter, err = durationEnv("DB_IDLE_JITTER"); err != nil {
+		return nil, err
+	} else if dbConfig.IdleJitter == 0 && os.Getenv("DB_IDLE_JITTER") != "" {
+		dbConfig.IdleJitter = -1 // no jitter
+	}
+	dbConfig.AcquireTimeout, err = durationEnv("DB_ACQUIRE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if dbConfig.PingTimeout, err = durationEnv("DB_PING_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	dbConfig.FailureBackoff, err = durationEnv("DB_FAILURE_BACKOFF")
+	if err != nil {
+		return nil, err
 	}
+	dbConfig.FailureMaxBackoff, err = durationEnv("DB_FAILURE_MAX_BACKOFF")
+	if err != nil {
+		return nil, err
+	}
+	dbConfig.LeaseDebug, err = parseBool(os.Getenv("DB_LEASE_DEBUG"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_LEASE_DEBUG: %w", err)
+	}
+	dbConfig.LeaseWarnAfter, err = durationEnv("DB_LEASE_WARN_AFTER")
+	if err != nil {
+		return nil, err
+	}
+	if dbConfig.Shards, err = parseInt(os.Getenv("DB_SHARDS")); err != nil {
+		return nil, fmt.Errorf("DB_SHARDS: %w", err)
+	}
+	dbConfig.WarmConns, err = parseInt(os.Getenv("DB_WARM_CONNS"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_WARM_CONNS: %w", err)
+	}
+	dbConfig.SnapshotInterval, err = durationEnv("DB_SNAPSHOT_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if err := dbConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("DB config: %w", err)
+	}
+
+	rwPin, err := durationEnv("DB_RW_PIN")
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := NewRegistry(
+		os.Getenv("APP_REGISTRY_FILE"), os.Getenv("APP_IDS"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Global{
+		db:       db.NewMgr(dbConfig),
+		registry: registry,
+		rwPin:    rwPin,
+	}, nil
 }
 
 // Global is our global state
 type Global struct {
 	// Manager of DB pools
 	db *db.Mgr
+	// Known apps. nil means every app is known.
+	registry *Registry
+	// How long reads are pinned to RW server after a write
+	rwPin time.Duration
+	// 1 after warm-up finished, see WarmUp
+	ready int32
+}
+
+// Reload reloads everything, which can be changed at runtime, like list of
+// known apps. Returns error if any or nil.
+func (self *Global) Reload() error {
+	if self.registry == nil {
+		return nil
+	}
+	return self.registry.Reload()
+}
+
+// WarmUp opens DB pools of hot apps, configured by DB_WARM_APPS and saved in
+// DB_SNAPSHOT_FILE, which are known apps, and marks we are ready to serve
+// requests after that. It's designed to be called in background on startup and
+// it stops, when ctx is done or global is closed. ctx should be cancelled and
+// WarmUp should return before [Global.Close], else Close waits for DB pools it
+// acquires. Returns number of warmed up apps of all hot apps.
+func (self *Global) WarmUp(ctx context.Context) (int, int) {
+	defer atomic.StoreInt32(&self.ready, 1)
+
+	apps := self.db.WarmApps()
+	known := apps[:0]
+	for _, appID := range apps {
+		if self.registry.Has(appID) {
+			known = append(known, appID)
+		}
+	}
+	return self.db.WarmUp(ctx, known), len(known)
+}
+
+// Ready returns true, when we are ready to serve requests, after WarmUp.
+func (self *Global) Ready() bool {
+	return atomic.LoadInt32(&self.ready) != 0
+}
+
+// DBLeases returns outstanding leases of DB per appID. It returns nil if debug
+// mode of leases is off.
+func (self *Global) DBLeases() map[string][]db.LeaseInfo {
+	return self.db.Leases()
+}
+
+// ClearDBFailure forgets recent failures of opening DB pools of appID, so the
+// next request of this app tries to open them immediately, without waiting for
+// end of DB_FAILURE_BACKOFF. Returns true if appID had failures.
+func (self *Global) ClearDBFailure(appID string) bool {
+	return self.db.ClearFailure(appID)
+}
+
+// Close closes global state. It waits, until all DB pools are released, and
+// closes them. If ctx is done before that, it closes them immediately. Returns
+// error if any or nil.
+func (self *Global) Close(ctx context.Context) error {
+	return self.db.Close(ctx)
 }
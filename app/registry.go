@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NewRegistry creates, loads and returns [Registry] of known apps. It reads
+// list of apps from file, one appID per line, and from list, where appIDs are
+// separated by commas or spaces. Both of them are optional, but if both of
+// them are empty, the registry knows about every app. Also it returns error
+// if any or nil.
+func NewRegistry(file, list string) (*Registry, error) {
+	r := &Registry{file: file, list: list}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Registry keeps list of known apps. We check appID against it before opening
+// DB pools for this app. It's safe to call its methods from different
+// goroutines.
+type Registry struct {
+	// Name of file with list of apps, one appID per line. Empty lines and lines
+	// started with "#" are ignored.
+	file string
+	// List of apps separated by commas or spaces.
+	list string
+	// Set of known appIDs. It's nil if we know about every app.
+	apps map[string]struct{}
+	mu   sync.RWMutex
+}
+
+// Has returns true if appID is known app. nil Registry knows every app.
+func (self *Registry) Has(appID string) bool {
+	if self == nil {
+		return true
+	}
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if self.apps == nil {
+		return true
+	}
+	_, ok := self.apps[appID]
+	return ok
+}
+
+// Reload reloads list of known apps from file and list and replaces current
+// list with new one. In case of errors it returns error and keeps current list
+// untouched.
+func (self *Registry) Reload() error {
+	if self.file == "" && self.list == "" {
+		return nil
+	}
+
+	apps := make(map[string]struct{})
+	for _, appID := range strings.FieldsFunc(self.list, isListSep) {
+		apps[appID] = struct{}{}
+	}
+
+	if self.file != "" {
+		if err := readAppsFile(self.file, apps); err != nil {
+			return err
+		}
+	}
+
+	self.mu.Lock()
+	self.apps = apps
+	self.mu.Unlock()
+
+	return nil
+}
+
+// isListSep returns true if r separates appIDs in a list
+func isListSep(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// readAppsFile reads appIDs from file with name into apps. Returns error if
+// any or nil.
+func readAppsFile(name string, apps map[string]struct{}) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		apps[line] = struct{}{}
+	}
+	return scanner.Err()
+}
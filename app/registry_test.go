@@ -0,0 +1,62 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryAll(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var nilReg *Registry
+	assert.True(nilReg.Has("demoa"))
+
+	r, err := NewRegistry("", "")
+	require.NoError(err)
+	assert.True(r.Has("demoa"))
+}
+
+func TestRegistryList(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	r, err := NewRegistry("", "demoa, demob democ")
+	require.NoError(err)
+	assert.True(r.Has("demoa"))
+	assert.True(r.Has("demob"))
+	assert.True(r.Has("democ"))
+	assert.False(r.Has("demod"))
+}
+
+func TestRegistryReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	file := filepath.Join(t.TempDir(), "apps")
+	require.NoError(os.WriteFile(file, []byte("# apps\ndemoa\n\n  demob\n"), 0o600))
+
+	r, err := NewRegistry(file, "democ")
+	require.NoError(err)
+	assert.True(r.Has("demoa"))
+	assert.True(r.Has("demob"))
+	assert.True(r.Has("democ"))
+	assert.False(r.Has("demod"))
+
+	require.NoError(os.WriteFile(file, []byte("demod\n"), 0o600))
+	require.NoError(r.Reload())
+	assert.False(r.Has("demoa"))
+	assert.True(r.Has("democ"))
+	assert.True(r.Has("demod"))
+
+	require.NoError(os.Remove(file))
+	assert.Error(r.Reload())
+	assert.True(r.Has("demod"), "failed Reload changed list of apps")
+
+	_, err = NewRegistry(file, "")
+	assert.Error(err)
+}
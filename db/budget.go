@@ -0,0 +1,66 @@
+package db
+
+// reserve reserves budget for n more pools. If the budget is exhausted, it
+// closes idle [DB] from oldest to freshest, until we have enough budget. If we
+// haven't, it returns [ErrOverloaded]. Every pool needs at least one
+// connection, so we can't have more pools than connections in the budget.
+func (self *Mgr) reserve(n int) error {
+	if self.dbConfig.MaxConns <= 0 {
+		return nil
+	}
+
+	self.budgetMu.Lock()
+	defer self.budgetMu.Unlock()
+
+	for self.openPools+n > self.dbConfig.MaxConns {
+		db, err := self.idle.evictOldest()
+		if db == nil {
+			return ErrOverloaded
+		}
+		self.openPools -= db.pools()
+		self.notify(func(o Observer) { o.OnClose(db.AppID(), "evict", err) })
+	}
+	self.openPools += n
+
+	return nil
+}
+
+// unreserve returns budget of n pools back, after they were closed or we
+// failed to open them.
+func (self *Mgr) unreserve(n int) {
+	if self.dbConfig.MaxConns <= 0 {
+		return
+	}
+
+	self.budgetMu.Lock()
+	self.openPools -= n
+	self.budgetMu.Unlock()
+}
+
+// closedDB returns budget of closed db back and gives it to other [DB]. op is
+// reason of closing and err is its error or nil, they are passed to observers.
+func (self *Mgr) closedDB(db *DB, op string, err error) {
+	self.unreserve(db.pools())
+	self.rebalance()
+	self.notify(func(o Observer) { o.OnClose(db.AppID(), op, err) })
+}
+
+// rebalance divides the global connection budget among all open pools, active
+// and idle ones. Every pool gets the same part of the budget, but not more,
+// than configured for it.
+func (self *Mgr) rebalance() {
+	if self.dbConfig.MaxConns <= 0 {
+		return
+	}
+
+	self.budgetMu.Lock()
+	openPools := self.openPools
+	self.budgetMu.Unlock()
+	if openPools == 0 {
+		return
+	}
+	limit := self.dbConfig.MaxConns / openPools
+
+	self.eachActive(func(db *DB) { db.limitConns(limit) })
+	self.idle.each(func(db *DB) { db.limitConns(limit) })
+}
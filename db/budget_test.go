@@ -0,0 +1,90 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:   "mysql",
+		HostRW:   "tcp(127.0.0.1)",
+		HostRO:   []string{"tcp(127.0.0.2)"},
+		MaxConns: 4,
+		// expiration loop doesn't run, while we advance clock by idle TTL
+		IdleInterval: time.Hour,
+	})
+
+	leaseA, err := m.DB("demoa")
+	r.NoError(err)
+	dba := leaseA.DB()
+	a.Equal(m.openPools, 2)
+	a.Equal(dba.RW().Stats().MaxOpenConnections, 2)
+
+	leaseB, err := m.DB("demob")
+	r.NoError(err)
+	dbb := leaseB.DB()
+	a.Equal(m.openPools, 4)
+	a.Equal(dba.RW().Stats().MaxOpenConnections, 1)
+	a.Equal(dbb.dbRO[0].db.Stats().MaxOpenConnections, 1)
+
+	_, err = m.DB("democ")
+	a.ErrorIs(err, ErrOverloaded)
+	a.Equal(m.openPools, 4)
+
+	leaseA.Release()
+	leaseC, err := m.DB("democ")
+	r.NoError(err)
+	a.NotNil(leaseC.DB())
+	a.Equal(m.openPools, 4)
+	a.False(m.idle.onIdle("demoa"))
+	a.Nil(dba.RW(), "evicted DB isn't closed")
+
+	leaseB.Release()
+	leaseC.Release()
+	m.clock.(*fakeClock).Advance(defMaxTTL)
+	m.idle.expire()
+	a.Equal(m.openPools, 0)
+}
+
+func TestBudgetUnlimited(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Zero(m.openPools)
+	a.Zero(lease.DB().RW().Stats().MaxOpenConnections)
+}
+
+func TestLimitConns(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	c := &Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		HostRO: []string{"tcp(127.0.0.2)"},
+		ROPool: PoolConfig{MaxOpenConns: 3},
+	}
+	db, err := newDB("demoa", c)
+	r.NoError(err)
+	defer db.close()
+	a.Equal(db.pools(), 2)
+
+	db.limitConns(5)
+	a.Equal(db.RW().Stats().MaxOpenConnections, 5)
+	a.Equal(db.dbRO[0].db.Stats().MaxOpenConnections, 3)
+
+	db.limitConns(0)
+	a.Equal(db.RW().Stats().MaxOpenConnections, 1)
+	a.Equal(db.dbRO[0].db.Stats().MaxOpenConnections, 1)
+}
@@ -0,0 +1,69 @@
+package db
+
+import "time"
+
+// Clock provides current time and timers for [Mgr], see [Config.Clock]. Real
+// clock is used by default, tests use a fake one, so they don't depend on real
+// time. Its methods can be called from different goroutines.
+type Clock interface {
+	// Now returns current time
+	Now() time.Time
+	// NewTimer creates and returns [Timer], which fires after d
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine after d and returns [Timer], which
+	// can cancel the call by its Stop method.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is [time.Timer] created by [Clock]
+type Timer interface {
+	// C returns channel, where the time is sent, when Timer fires. It's nil
+	// for Timer created by [Clock.AfterFunc].
+	C() <-chan time.Time
+	// Stop prevents Timer from firing, see [time.Timer.Stop]
+	Stop() bool
+	// Reset changes Timer to fire after d, see [time.Timer.Reset]
+	Reset(d time.Duration) bool
+}
+
+// realClock is [Clock] of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// realTimer is [Timer] of realClock
+type realTimer struct {
+	*time.Timer
+}
+
+func (self realTimer) C() <-chan time.Time {
+	return self.Timer.C
+}
+
+// clock returns [Config.Clock] or real clock, if it isn't defined.
+func (self *Config) clock() Clock {
+	if self.Clock != nil {
+		return self.Clock
+	}
+	return realClock{}
+}
+
+// stopTimer stops t and drains its channel, so t can be reset.
+func stopTimer(t Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is [Clock], which time is changed by Advance only
+type fakeClock struct {
+	now    time.Time
+	timers map[*fakeTimer]struct{} // active timers
+	mu     sync.Mutex
+}
+
+// fakeTimer is [Timer] of fakeClock
+type fakeTimer struct {
+	clock  *fakeClock
+	fireAt time.Time
+	ch     chan time.Time
+	fn     func() // for AfterFunc
+}
+
+// newFakeClock returns fakeClock, which starts at fixed time
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (self *fakeClock) Now() time.Time {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.now
+}
+
+func (self *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: self, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (self *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: self, fn: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves time forward by d and fires timers, which time has come, in
+// the order of their time. Functions of AfterFunc are called synchronously.
+func (self *fakeClock) Advance(d time.Duration) {
+	self.mu.Lock()
+	self.now = self.now.Add(d)
+	now := self.now
+	var fired []*fakeTimer
+	for t := range self.timers {
+		if !t.fireAt.After(now) {
+			fired = append(fired, t)
+			delete(self.timers, t)
+		}
+	}
+	sort.Slice(fired, func(i, j int) bool {
+		return fired[i].fireAt.Before(fired[j].fireAt)
+	})
+	self.mu.Unlock()
+
+	for _, t := range fired {
+		if t.fn != nil {
+			t.fn()
+			continue
+		}
+		select {
+		case t.ch <- now:
+		default:
+		}
+	}
+}
+
+// numTimers returns number of active timers. Tests use it for waiting, until
+// a goroutine starts waiting for a timer.
+func (self *fakeClock) numTimers() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.timers)
+}
+
+// waitTimers waits, until fakeClock has n active timers, and fails t if it
+// doesn't happen soon.
+func (self *fakeClock) waitTimers(t testing.TB, n int) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return self.numTimers() == n },
+		time.Second, time.Millisecond)
+}
+
+func (self *fakeTimer) C() <-chan time.Time {
+	return self.ch
+}
+
+func (self *fakeTimer) Stop() bool {
+	self.clock.mu.Lock()
+	defer self.clock.mu.Unlock()
+	_, active := self.clock.timers[self]
+	delete(self.clock.timers, self)
+	return active
+}
+
+func (self *fakeTimer) Reset(d time.Duration) bool {
+	self.clock.mu.Lock()
+	_, active := self.clock.timers[self]
+	self.fireAt = self.clock.now.Add(d)
+	self.clock.timers[self] = struct{}{}
+	self.clock.mu.Unlock()
+
+	if d <= 0 {
+		self.clock.Advance(0)
+	}
+	return active
+}
+
+func TestFakeClock(t *testing.T) {
+	a := assert.New(t)
+
+	clock := newFakeClock()
+	start := clock.Now()
+	timer := clock.NewTimer(time.Minute)
+	var called []string
+	clock.AfterFunc(2*time.Minute, func() { called = append(called, "func") })
+	a.Equal(clock.numTimers(), 2)
+
+	clock.Advance(59 * time.Second)
+	a.Equal(clock.Now(), start.Add(59*time.Second))
+	a.Empty(timer.C())
+
+	clock.Advance(time.Second)
+	a.Equal(<-timer.C(), start.Add(time.Minute))
+	a.False(timer.Stop())
+	a.Equal(clock.numTimers(), 1)
+
+	a.False(timer.Reset(time.Minute))
+	a.True(timer.Stop())
+	clock.Advance(time.Hour)
+	a.Empty(timer.C())
+	a.Equal(called, []string{"func"})
+	a.Zero(clock.numTimers())
+}
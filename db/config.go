@@ -1,6 +1,10 @@
 package db
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Config contains options for connecting to SQL server
 type Config struct {
@@ -8,31 +12,268 @@ type Config struct {
 	User   string // username
 	Pass   string // password
 	HostRW string // [protocol[(address)]] for main (RW) connection
-	// Same for optional replica connection. Shoul be empty string if not used.
-	HostRO string
+	// Same for optional replica connections, one per replica. Shoul be empty if
+	// not used.
+	HostRO []string
+	// How [DB.RO] selects replica: [BalanceRoundRobin] (default) or
+	// [BalanceLeastInFlight].
+	ROBalance string
+	// Max replication lag of healthy replica. Replicas with bigger lag are
+	// skipped by [DB.RO]. Zero means we don't check replication lag.
+	ROMaxLag time.Duration
+	// Optional params of the driver, which are added to DSN, like "charset".
+	Params map[string]string
+	RWPool PoolConfig // options of RW pool
+	ROPool PoolConfig // options of every RO pool
+	// Global budget of connections of all pools of all apps. It's divided among
+	// open pools equally. Zero means unlimited.
+	MaxConns int
+	// Max number of idle apps, which pools are kept open. When we have more, the
+	// least recently used ones are closed. Zero means unlimited.
+	MaxIdleDBs int
+	// Time-To-Live of idle app. If nobody asked its DB during this time, its
+	// pools are closed. Zero means [defMaxTTL].
+	IdleTTL time.Duration
+	// Min interval between checks of expired idle apps. Zero means
+	// [defExpirationInterval].
+	IdleInterval time.Duration
+	// Max random duration added to IdleInterval. Zero means
+	// [defExpirationJitter] and negative value means no jitter.
+	IdleJitter time.Duration
+	// Max time [Mgr.DBContext] waits for pools of an app. Zero means it waits
+	// until its context is done.
+	AcquireTimeout time.Duration
+	// Max time of checking connection to every server, when we open pools of an
+	// app. Zero means we don't check connections and errors are returned by the
+	// first query.
+	PingTimeout time.Duration
+	// Backoff after the first failure of opening pools of an app. Every next
+	// failure in a row doubles it, up to FailureMaxBackoff. During backoff
+	// [Mgr.DB] returns the last error of the app. Zero means
+	// [defFailureBackoff].
+	FailureBackoff time.Duration
+	// Max backoff after failures of opening pools of an app. Zero means
+	// [defFailureMaxBackoff].
+	FailureMaxBackoff time.Duration
+	// Debug mode of leases. If it's true, [Mgr] records who acquires every
+	// [Lease], logs warnings about leases held longer than LeaseWarnAfter and
+	// returns outstanding leases by [Mgr.Leases].
+	LeaseDebug bool
+	// Duration of holding [Lease], after which we log a warning in debug mode.
+	// Zero means [defLeaseWarnAfter].
+	LeaseWarnAfter time.Duration
+	// Number of shards of active apps in [Mgr]. Every shard has its own lock, so
+	// more shards mean less contention between requests of different apps.
+	// Zero means [defShards].
+	Shards int
+	// Apps, which pools are opened on startup by [Mgr.WarmUp]
+	WarmApps []string
+	// Optional file, where [Mgr] periodically saves snapshot of hot apps: last
+	// use time and request rate of every active and idle app. [NewMgr] loads
+	// it, so [Mgr.WarmApps] returns hot apps before restart, and warmed up apps
+	// keep their LRU order.
+	SnapshotFile string
+	// Interval of saving snapshot into SnapshotFile. It's saved by [Mgr.Close]
+	// too. Zero means [defSnapshotInterval].
+	SnapshotInterval time.Duration
+	// Number of ready connections of every pool after warm-up. Zero means
+	// [defWarmConns]. Connections above MaxIdleConns of a pool aren't kept.
+	WarmConns int
+	// Clock of [Mgr]. nil means real clock, tests use a fake one.
+	Clock Clock
+	// Source of random jitter of idle apps expiration, it returns random
+	// number in [0, n). nil means [math/rand.Int63n], tests use a fixed one.
+	Rand func(n int64) int64
+	// Optional per app overrides of this Config. Key is appID.
+	Apps map[string]AppConfig
 }
 
-// hasRO returns do Config has defined HostRO
-func (self *Config) hasRO() bool {
-	return self.HostRO != ""
+// PoolConfig contains options of a pool of DB connections. Zero value of every
+// field means we use default value of [sql.DB].
+type PoolConfig struct {
+	// Max number of open connections, see [sql.DB.SetMaxOpenConns].
+	MaxOpenConns int
+	// Max number of idle connections, see [sql.DB.SetMaxIdleConns]. Negative
+	// value means we don't keep idle connections.
+	MaxIdleConns int
+	// Max time a connection may be reused, see [sql.DB.SetConnMaxLifetime].
+	// Zero value means [defConnMaxLifetime].
+	ConnMaxLifetime time.Duration
+	// Max time a connection may be idle, see [sql.DB.SetConnMaxIdleTime].
+	ConnMaxIdleTime time.Duration
+}
+
+// merge returns copy of this PoolConfig with every non zero field of o
+// applied.
+func (self PoolConfig) merge(o PoolConfig) PoolConfig {
+	if o.MaxOpenConns != 0 {
+		self.MaxOpenConns = o.MaxOpenConns
+	}
+	if o.MaxIdleConns != 0 {
+		self.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.ConnMaxLifetime != 0 {
+		self.ConnMaxLifetime = o.ConnMaxLifetime
+	}
+	if o.ConnMaxIdleTime != 0 {
+		self.ConnMaxIdleTime = o.ConnMaxIdleTime
+	}
+	return self
 }
 
-// host returns content of HostRW (true) or HostRO (false) depending on value of
-// rw.
-func (self *Config) host(rw bool) string {
-	if rw {
-		return self.HostRW
-	} else {
-		return self.HostRO
+// validate checks this PoolConfig and returns error if any or nil.
+func (self PoolConfig) validate() error {
+	switch {
+	case self.ConnMaxLifetime < 0:
+		return errors.New("negative max lifetime of connections")
+	case self.ConnMaxIdleTime < 0:
+		return errors.New("negative max idle time of connections")
 	}
+	return nil
+}
+
+// AppConfig contains per app overrides of [Config]. Every empty field means we
+// use value of the same field from [Config].
+type AppConfig struct {
+	User   string   // username
+	Pass   string   // password
+	HostRW string   // [protocol[(address)]] for main (RW) connection
+	HostRO []string // same for optional replica connections
+	// Params of the driver. They are merged with Params from [Config] and
+	// override them.
+	Params map[string]string
+	// Options of pools. Every non zero field overrides the same field from
+	// [Config].
+	RWPool PoolConfig
+	ROPool PoolConfig
+	// Time-To-Live of idle app, overrides IdleTTL from [Config].
+	IdleTTL time.Duration
+}
+
+// appConfig returns Config for appID. If Apps has overrides for appID, it
+// returns copy of this Config with overrides applied, else it returns this
+// Config.
+func (self *Config) appConfig(appID string) *Config {
+	app, ok := self.Apps[appID]
+	if !ok {
+		return self
+	}
+
+	c := *self
+	c.Apps = nil
+	if app.User != "" {
+		c.User = app.User
+	}
+	if app.Pass != "" {
+		c.Pass = app.Pass
+	}
+	if app.HostRW != "" {
+		c.HostRW = app.HostRW
+	}
+	if len(app.HostRO) > 0 {
+		c.HostRO = app.HostRO
+	}
+	c.RWPool = c.RWPool.merge(app.RWPool)
+	c.ROPool = c.ROPool.merge(app.ROPool)
+	if app.IdleTTL != 0 {
+		c.IdleTTL = app.IdleTTL
+	}
+
+	if len(app.Params) > 0 {
+		c.Params = make(map[string]string, len(self.Params)+len(app.Params))
+		for k, v := range self.Params {
+			c.Params[k] = v
+		}
+		for k, v := range app.Params {
+			c.Params[k] = v
+		}
+	}
+
+	return &c
+}
+
+// Validate checks this Config and returns error, if something is wrong with
+// it, or nil. It's designed to be called once on startup, before [NewMgr].
+func (self *Config) Validate() error {
+	if _, err := dsnBuilder(self.Driver); err != nil {
+		return err
+	} else if !validBalance(self.ROBalance) {
+		return fmt.Errorf("unknown balance of replicas: %q", self.ROBalance)
+	} else if self.ROMaxLag > 0 && lagFuncs[self.Driver] == nil {
+		return fmt.Errorf("replication lag of driver %q isn't supported",
+			self.Driver)
+	}
+
+	switch {
+	case self.ROMaxLag < 0:
+		return errors.New("negative max replication lag")
+	case self.MaxConns < 0:
+		return errors.New("negative max number of connections")
+	case self.MaxIdleDBs < 0:
+		return errors.New("negative max number of idle apps")
+	case self.IdleTTL < 0:
+		return errors.New("negative TTL of idle apps")
+	case self.IdleInterval < 0:
+		return errors.New("negative interval of idle apps expiration")
+	case self.AcquireTimeout < 0:
+		return errors.New("negative timeout of acquiring DB")
+	case self.PingTimeout < 0:
+		return errors.New("negative timeout of ping")
+	case self.FailureBackoff < 0:
+		return errors.New("negative backoff of failures")
+	case self.FailureMaxBackoff < 0:
+		return errors.New("negative max backoff of failures")
+	case self.LeaseWarnAfter < 0:
+		return errors.New("negative duration of lease warning")
+	case self.Shards < 0:
+		return errors.New("negative number of shards")
+	case self.WarmConns < 0:
+		return errors.New("negative number of warm connections")
+	case self.SnapshotInterval < 0:
+		return errors.New("negative interval of snapshots")
+	}
+
+	if err := self.validateApp(); err != nil {
+		return err
+	}
+
+	for appID, app := range self.Apps {
+		if err := self.appConfig(appID).validateApp(); err != nil {
+			return fmt.Errorf("app %q: %w", appID, err)
+		} else if app.IdleTTL < 0 {
+			return fmt.Errorf("app %q: negative TTL of idle app", appID)
+		}
+	}
+	return nil
+}
+
+// validateApp checks options of this Config, which can be overridden per app,
+// and returns error if any or nil.
+func (self *Config) validateApp() error {
+	if err := self.RWPool.validate(); err != nil {
+		return fmt.Errorf("RW pool: %w", err)
+	} else if err := self.ROPool.validate(); err != nil {
+		return fmt.Errorf("RO pool: %w", err)
+	}
+	return nil
+}
+
+// hasRO returns do Config has defined HostRO
+func (self *Config) hasRO() bool {
+	return len(self.HostRO) > 0
 }
 
 // FormatDSN formats the given Config into a DSN string which can be passed to
-// the driver.
+// the driver. It uses [DSNBuilder] registered for Driver. Returns error if any
+// or nil.
 //
 // dbName is database name we are connecting to.
 //
-// rw defines are we connecting to HostRW (true) or HostRO (false).
-func (self *Config) formatDSN(dbName string, rw bool) string {
-	return fmt.Sprintf("%s:%s@%s/%s", self.User, self.Pass, self.host(rw), dbName)
+// host is HostRW or one of HostRO we are connecting to.
+func (self *Config) formatDSN(dbName, host string) (string, error) {
+	b, err := dsnBuilder(self.Driver)
+	if err != nil {
+		return "", err
+	}
+	return b.FormatDSN(self, dbName, host)
 }
@@ -2,8 +2,10 @@ package db
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHasRO(t *testing.T) {
@@ -11,27 +13,126 @@ func TestHasRO(t *testing.T) {
 
 	c := &Config{}
 	assert.False(c.hasRO())
-	c.HostRO = "something"
+	c.HostRO = []string{"something"}
 	assert.True(c.hasRO())
 }
 
-func TestHost(t *testing.T) {
+func TestFormatDSN(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
-	c := &Config{HostRW: "tcp(db1)", HostRO: "tcp(db2)"}
-	assert.Equal(c.host(true), c.HostRW, "Didn't get value of HostRW")
-	assert.Equal(c.host(false), c.HostRO, "Didn't get value of HostRO")
+	c := &Config{
+		Driver: "mysql",
+		User:   "user",
+		Pass:   "password",
+	}
+	dsn, err := c.formatDSN("test", "tcp(db1)")
+	require.NoError(err)
+	assert.Equal(dsn, "user:password@tcp(db1)/test")
+	dsn, err = c.formatDSN("test", "tcp(db2)")
+	require.NoError(err)
+	assert.Equal(dsn, "user:password@tcp(db2)/test")
+
+	c.Driver = "unknown"
+	_, err = c.formatDSN("test", "tcp(db1)")
+	assert.Error(err)
 }
 
-func TestFormatDSN(t *testing.T) {
+func TestFormatDSNParams(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
 	c := &Config{
+		Driver: "mysql",
+		User:   "user",
+		Pass:   "password",
+		Params: map[string]string{"parseTime": "true", "charset": "utf8mb4"},
+	}
+	dsn, err := c.formatDSN("test", "tcp(db1)")
+	require.NoError(err)
+	assert.Equal(dsn, "user:password@tcp(db1)/test?parseTime=true&charset=utf8mb4")
+}
+
+func TestAppConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Config{
+		Driver: "mysql",
 		User:   "user",
 		Pass:   "password",
 		HostRW: "tcp(db1)",
-		HostRO: "tcp(db2)",
+		HostRO: []string{"tcp(db2)"},
+		Params: map[string]string{"charset": "utf8mb4", "parseTime": "true"},
+		RWPool: PoolConfig{MaxOpenConns: 10, MaxIdleConns: 5},
+		Apps: map[string]AppConfig{
+			"demob": {
+				User:   "userb",
+				Pass:   "passb",
+				HostRW: "tcp(db3)",
+				Params: map[string]string{"charset": "latin1"},
+				RWPool: PoolConfig{MaxOpenConns: 20},
+				ROPool: PoolConfig{ConnMaxIdleTime: time.Minute},
+			},
+		},
+	}
+
+	assert.Same(c.appConfig("demoa"), c)
+
+	b := c.appConfig("demob")
+	assert.NotSame(b, c)
+	assert.Equal(b.Driver, "mysql")
+	assert.Equal(b.User, "userb")
+	assert.Equal(b.Pass, "passb")
+	assert.Equal(b.HostRW, "tcp(db3)")
+	assert.Equal(b.HostRO, []string{"tcp(db2)"})
+	assert.Equal(b.Params,
+		map[string]string{"charset": "latin1", "parseTime": "true"})
+	assert.Equal(b.RWPool, PoolConfig{MaxOpenConns: 20, MaxIdleConns: 5})
+	assert.Equal(b.ROPool, PoolConfig{ConnMaxIdleTime: time.Minute})
+	assert.Nil(b.Apps)
+	assert.Equal(c.Params["charset"], "utf8mb4", "global Params changed")
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Config{Driver: "mysql", HostRW: "tcp(db1)"}
+	assert.NoError(c.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"unknown driver", func(c *Config) { c.Driver = "unknown" }},
+		{"unknown balance", func(c *Config) { c.ROBalance = "random" }},
+		{"lag of driver", func(c *Config) {
+			c.Driver = "unknown"
+			c.ROMaxLag = time.Second
+		}},
+		{"max conns", func(c *Config) { c.MaxConns = -1 }},
+		{"max idle apps", func(c *Config) { c.MaxIdleDBs = -1 }},
+		{"idle TTL", func(c *Config) { c.IdleTTL = -time.Second }},
+		{"idle interval", func(c *Config) { c.IdleInterval = -time.Second }},
+		{"shards", func(c *Config) { c.Shards = -1 }},
+		{"snapshot interval", func(c *Config) {
+			c.SnapshotInterval = -time.Second
+		}},
+		{"RW pool", func(c *Config) {
+			c.RWPool.ConnMaxLifetime = -time.Second
+		}},
+		{"app idle TTL", func(c *Config) {
+			c.Apps = map[string]AppConfig{"demoa": {IdleTTL: -time.Second}}
+		}},
+		{"app RO pool", func(c *Config) {
+			c.Apps = map[string]AppConfig{
+				"demoa": {ROPool: PoolConfig{ConnMaxIdleTime: -time.Second}},
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		c := Config{Driver: "mysql", HostRW: "tcp(db1)"}
+		tt.modify(&c)
+		assert.Error(c.Validate(), tt.name)
 	}
-	assert.Equal(c.formatDSN("test", true), "user:password@tcp(db1)/test")
-	assert.Equal(c.formatDSN("test", false), "user:password@tcp(db2)/test")
 }
@@ -1,56 +1,153 @@
 package db
 
 import (
-	"sync"
+	"fmt"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/jmoiron/sqlx"
 )
 
+const (
+	// Default max time a connection may be reused.
+	defConnMaxLifetime = 3 * time.Minute
+
+	// Default max number of idle connections, the same as in [sql.DB].
+	defMaxIdleConns = 2
+)
+
 // newDB creates and returns pool of DB connections to database with name in
 // appID. It creates and initialize an instance of [DB]. In case of errors it
-// returns error, else - nil as an error.
+// returns error, else - nil as an error. If [Config.PingTimeout] is defined, it
+// checks connections to servers and returns [ConnError], if RW server isn't
+// available.
 //
 // dbConfig contains data for connecting to SQL server.
 func newDB(appID string, dbConfig *Config) (*DB, error) {
-	dbRW, err := sqlx.Open(dbConfig.Driver, dbConfig.formatDSN(appID, true))
+	if !validBalance(dbConfig.ROBalance) {
+		return nil, fmt.Errorf("unknown balance of replicas: %q",
+			dbConfig.ROBalance)
+	} else if dbConfig.ROMaxLag > 0 && lagFuncs[dbConfig.Driver] == nil {
+		return nil, fmt.Errorf("replication lag of driver %q isn't supported",
+			dbConfig.Driver)
+	}
+
+	dbRW, err := openDB(appID, dbConfig, dbConfig.HostRW)
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{appID: appID, dbRW: dbRW}
+	db := &DB{
+		appID:     appID,
+		dbRW:      dbRW,
+		roBalance: dbConfig.ROBalance,
+		rwPool:    dbConfig.RWPool,
+		roPool:    dbConfig.ROPool,
+		idleTTL:   dbConfig.IdleTTL,
+	}
 
-	if dbConfig.hasRO() {
-		dbRO, err := sqlx.Open(dbConfig.Driver, dbConfig.formatDSN(appID, false))
+	for _, host := range dbConfig.HostRO {
+		dbRO, err := openDB(appID, dbConfig, host)
 		if err != nil {
-			dbRW.Close()
+			db.close()
+			return nil, err
+		}
+		configureDB(dbRO, dbConfig.ROPool)
+		db.dbRO = append(db.dbRO, newReplica(dbRO, host,
+			lagFuncs[dbConfig.Driver], dbConfig.ROMaxLag, dbConfig.clock()))
+	}
+	configureDB(db.RW(), dbConfig.RWPool)
+	db.numPools = 1 + len(db.dbRO)
+
+	if dbConfig.PingTimeout > 0 {
+		if err := db.ping(dbConfig.HostRW, dbConfig.PingTimeout); err != nil {
+			db.close()
 			return nil, err
 		}
-		db.dbRO = dbRO
-		configureDB(db.RO())
 	}
-	configureDB(db.RW())
 
 	return db, nil
 }
 
-// configureDB configures pool of DB connections db before using it
-func configureDB(db *sqlx.DB) {
-	db.SetConnMaxLifetime(3 * time.Minute)
+// ping checks connections to RW server hostRW and every replica, waiting no
+// longer than timeout for every server. It returns [ConnError] if RW server
+// failed or nil. Failed replicas are marked unhealthy and [DB.RO] skips them,
+// until they pass health check.
+func (self *DB) ping(hostRW string, timeout time.Duration) error {
+	errCh := make(chan error, len(self.dbRO))
+	for _, r := range self.dbRO {
+		go func(r *replica) {
+			err := pingDB(r.db, r.host, timeout)
+			if err != nil {
+				r.fail(err)
+			}
+			errCh <- err
+		}(r)
+	}
+
+	err := pingDB(self.dbRW, hostRW, timeout)
+	for range self.dbRO {
+		<-errCh
+	}
+	return err
+}
+
+// openDB opens pool of DB connections to database appID on host and returns
+// it. host is HostRW or one of HostRO. Also it returns error if any or nil.
+func openDB(appID string, dbConfig *Config, host string) (*sqlx.DB, error) {
+	dsn, err := dbConfig.formatDSN(appID, host)
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.Open(dbConfig.Driver, dsn)
+}
+
+// configureDB configures pool of DB connections db before using it, according
+// to options in c.
+func configureDB(db *sqlx.DB, c PoolConfig) {
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = defConnMaxLifetime
+	}
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+
+	if c.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
 }
 
 // DB defines pool of connections to a database of specific appID. It's safe to
 // call methods from different goroutines.
 type DB struct {
+	// Usage statistics for snapshots. It's the first field, because of
+	// alignment of its 64-bit atomic counters.
+	stats appStats
 	// Name of database and ID of this app
 	appID string
 	// Pool of read-write connections to the DB
 	dbRW *sqlx.DB
-	// Pool of read-only connections. May be nil if we don't have replicas.
-	dbRO *sqlx.DB
-	mu   sync.RWMutex
-	// How many goroutines use this object at this moment
-	useCnt int
+	// Pools of read-only connections, one per replica. May be empty if we don't
+	// have replicas.
+	dbRO []*replica
+	// How RO selects replica
+	roBalance string
+	// Counter of round-robin selection of replicas
+	roNext uint32
+	// Configured options of pools
+	rwPool PoolConfig
+	roPool PoolConfig
+	// Number of pools, RW and RO
+	numPools int
+	// TTL of this DB, when it's idle. Zero means default TTL of [idleMgr].
+	idleTTL time.Duration
+	// Number of active [Lease] of this DB. It's changed by [Mgr] atomically,
+	// but DB becomes idle only under lock of [Mgr].
+	refs int32
 }
 
 // AppID returns application ID for which this DB was created
@@ -58,32 +155,6 @@ func (self *DB) AppID() string {
 	return self.appID
 }
 
-// use just thread-safe increases num of active usage of this DB. It marks this
-// DB has one more active usage. Should be called every time before usage.
-func (self *DB) use() {
-	self.mu.Lock()
-	self.useCnt++
-	self.mu.Unlock()
-}
-
-// inUse returns true if this DB is still active. It means someone uses it at
-// this moment.
-func (self *DB) inUse() bool {
-	self.mu.RLock()
-	cnt := self.useCnt
-	self.mu.RUnlock()
-	return cnt > 0
-}
-
-// release marks we don't use this DB anymore. Should be called every time we
-// don't need this DB any more. When nobody else uses it, inUse will return
-// false.
-func (self *DB) release() {
-	self.mu.Lock()
-	self.useCnt--
-	self.mu.Unlock()
-}
-
 // RW returns [*sqlx.DB] pool of connections to read-write server. Should be
 // always non nil.
 func (self *DB) RW() *sqlx.DB {
@@ -91,25 +162,106 @@ func (self *DB) RW() *sqlx.DB {
 }
 
 // RO returns [*sqlx.DB] pool of connections to read-only replica, if
-// any. Because replica is optional, RO can return nil in this case.
+// any. Because replica is optional, RO can return nil in this case. If we have
+// more than one replica, RO selects one of them on every call, skipping
+// replicas which failed health check. If all replicas failed, RO falls back to
+// RW pool, until one of replicas is alive again.
 func (self *DB) RO() *sqlx.DB {
-	return self.dbRO
+	if len(self.dbRO) == 0 {
+		return nil
+	} else if r := pickReplica(self.dbRO, self.roBalance, &self.roNext); r != nil {
+		return r.db
+	}
+	return self.dbRW
+}
+
+// ReportRO reports err returned by ro pool, which we've got from RO. If err is
+// a connection error, we stop reading from this replica, until it's alive
+// again. It returns err as is, so it can be used like
+//
+//   return db.ReportRO(ro, ro.Get(&v, query))
+func (self *DB) ReportRO(ro *sqlx.DB, err error) error {
+	if err == nil || !isConnError(err) {
+		return err
+	}
+
+	for _, r := range self.dbRO {
+		if r.db == ro {
+			r.fail(err)
+			break
+		}
+	}
+	return err
+}
+
+// pools returns number of pools of this DB: one RW pool and one RO pool per
+// replica. It returns the same number after close.
+func (self *DB) pools() int {
+	return self.numPools
+}
+
+// limitConns limits max number of open connections of every pool to limit, but
+// not more than configured for the pool.
+func (self *DB) limitConns(limit int) {
+	limitPoolConns(self.dbRW, self.rwPool, limit)
+	for _, r := range self.dbRO {
+		limitPoolConns(r.db, self.roPool, limit)
+	}
+}
+
+// limitPoolConns limits max number of open connections of pool db to limit or
+// to MaxOpenConns of c, which one is less. Also it limits max number of idle
+// connections, because [sql.DB] doesn't restore it, when we increase the limit.
+func limitPoolConns(db *sqlx.DB, c PoolConfig, limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	if c.MaxOpenConns > 0 && c.MaxOpenConns < limit {
+		limit = c.MaxOpenConns
+	}
+
+	idle := c.MaxIdleConns
+	if idle == 0 {
+		idle = defMaxIdleConns
+	}
+	if idle > limit {
+		idle = limit
+	}
+
+	db.SetMaxOpenConns(limit)
+	db.SetMaxIdleConns(idle)
+}
+
+// ROLag returns max replication lag of healthy replicas from their last
+// health checks. It's always 0 if we don't have replicas or don't check
+// replication lag.
+func (self *DB) ROLag() time.Duration {
+	var lag time.Duration
+	for _, r := range self.dbRO {
+		if l := r.replicationLag(); r.isHealthy() && l > lag {
+			lag = l
+		}
+	}
+	return lag
 }
 
 // close closes all [*sqlx.DB] pools. Returns error or nil. It isn't safe to
 // call it concurrently.
 func (self *DB) close() error {
-	if self.RO() != nil {
-		if err := self.RO().Close(); err != nil {
+	for len(self.dbRO) > 0 {
+		if err := self.dbRO[0].db.Close(); err != nil {
 			return err
 		}
-		self.dbRO = nil
+		self.dbRO = self.dbRO[1:]
 	}
+	self.dbRO = nil
 
-	if err := self.RW().Close(); err != nil {
-		return err
+	if self.dbRW != nil {
+		if err := self.dbRW.Close(); err != nil {
+			return err
+		}
+		self.dbRW = nil
 	}
-	self.dbRW = nil
 
 	return nil
 }
@@ -1,7 +1,10 @@
 package db
 
 import (
+	"database/sql/driver"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,7 +20,7 @@ func TestNewDB(t *testing.T) {
 	assert.NotNil(db.RW())
 	assert.Nil(db.RO())
 
-	c.HostRO = c.HostRW
+	c.HostRO = []string{c.HostRW}
 	db, err = newDB("demoa", c)
 	require.NoError(err)
 	assert.NotNil(db.RO())
@@ -33,45 +36,124 @@ func TestAppID(t *testing.T) {
 	assert.Equal(db.AppID(), "demoa")
 }
 
-func TestUseInUseRelease(t *testing.T) {
+func TestClose(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
 	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
 	db, err := newDB("demoa", c)
 	require.NoError(err)
-	assert.Equal(db.useCnt, 0)
-	assert.False(db.inUse())
+	assert.NotNil(db.RW())
 
-	db.use()
-	assert.Equal(db.useCnt, 1)
-	assert.True(db.inUse())
+	err = db.close()
+	require.NoError(err)
+	assert.Nil(db.RW())
 
-	db.release()
-	assert.Equal(db.useCnt, 0)
-	assert.False(db.inUse())
+	c.HostRO = []string{c.HostRW}
+	db, err = newDB("demoa", c)
+	require.NoError(err)
+	assert.NotNil(db.RO())
+
+	err = db.close()
+	require.NoError(err)
+	assert.Nil(db.RW())
+	assert.Nil(db.RO())
 }
 
-func TestClose(t *testing.T) {
+func TestNewDBPgx(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	c := &Config{Driver: "pgx", HostRW: "127.0.0.1:5432", HostRO: []string{"127.0.0.1"}}
 	db, err := newDB("demoa", c)
 	require.NoError(err)
 	assert.NotNil(db.RW())
+	assert.NotNil(db.RO())
+	require.NoError(db.close())
+}
 
-	err = db.close()
+func TestNewDBReplicas(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := &Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		HostRO: []string{"tcp(127.0.0.2)", "tcp(127.0.0.3)"},
+	}
+	db, err := newDB("demoa", c)
 	require.NoError(err)
-	assert.Nil(db.RW())
+	require.Len(db.dbRO, 2)
+	for _, r := range db.dbRO {
+		r.checkedAt = time.Now().UnixNano()
+	}
+	assert.Same(db.RO(), db.dbRO[1].db)
+	assert.Same(db.RO(), db.dbRO[0].db)
+
+	assert.Nil(db.ReportRO(db.dbRO[0].db, nil))
+	err = errors.New("syntax error")
+	assert.Same(db.ReportRO(db.dbRO[0].db, err), err)
+	assert.True(db.dbRO[0].isHealthy())
+
+	assert.Same(db.ReportRO(db.dbRO[0].db, driver.ErrBadConn), driver.ErrBadConn)
+	assert.False(db.dbRO[0].isHealthy())
+	assert.Same(db.RO(), db.dbRO[1].db)
+	assert.Same(db.RO(), db.dbRO[1].db)
+
+	db.ReportRO(db.dbRO[1].db, driver.ErrBadConn)
+	assert.Same(db.RO(), db.RW(), "no fallback to RW")
+	require.NoError(db.close())
+
+	c.ROBalance = "random"
+	_, err = newDB("demoa", c)
+	assert.Error(err)
+}
+
+func TestROLag(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
+	assert.Zero(db.ROLag())
 
-	c.HostRO = c.HostRW
+	c.HostRO = []string{"tcp(127.0.0.2)", "tcp(127.0.0.3)"}
+	c.ROMaxLag = time.Minute
 	db, err = newDB("demoa", c)
 	require.NoError(err)
-	assert.NotNil(db.RO())
+	db.dbRO[0].lag = int64(time.Second)
+	db.dbRO[1].lag = int64(2 * time.Second)
+	assert.Equal(db.ROLag(), 2*time.Second)
+	db.dbRO[1].healthy = 0
+	assert.Equal(db.ROLag(), time.Second)
+
+	c.Driver = "test"
+	RegisterDSNBuilder("test", testDSN{})
+	t.Cleanup(func() {
+		dsnBuildersMu.Lock()
+		delete(dsnBuilders, "test")
+		dsnBuildersMu.Unlock()
+	})
+	_, err = newDB("demoa", c)
+	assert.Error(err, "lag of unknown driver")
+}
 
-	err = db.close()
+func TestConfigureDB(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := &Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		HostRO: []string{"tcp(127.0.0.2)"},
+		RWPool: PoolConfig{MaxOpenConns: 10},
+		ROPool: PoolConfig{MaxOpenConns: 5},
+	}
+	db, err := newDB("demoa", c)
 	require.NoError(err)
-	assert.Nil(db.RW())
-	assert.Nil(db.RO())
+	defer db.close()
+
+	assert.Equal(db.RW().Stats().MaxOpenConnections, 10)
+	assert.Equal(db.dbRO[0].db.Stats().MaxOpenConnections, 5)
 }
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDSN struct{}
+
+func (testDSN) FormatDSN(c *Config, dbName, host string) (string, error) {
+	return host + "/" + dbName, nil
+}
+
+func TestRegisterDSNBuilder(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	_, err := dsnBuilder("test")
+	require.Error(err)
+
+	RegisterDSNBuilder("test", testDSN{})
+	t.Cleanup(func() {
+		dsnBuildersMu.Lock()
+		delete(dsnBuilders, "test")
+		dsnBuildersMu.Unlock()
+	})
+
+	c := &Config{Driver: "test"}
+	dsn, err := c.formatDSN("demoa", "db1")
+	require.NoError(err)
+	assert.Equal(dsn, "db1/demoa")
+}
+
+func TestSplitHost(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct{ host, net, addr string }{
+		{"", "", ""},
+		{"tcp", "tcp", ""},
+		{"tcp(db1:3306)", "tcp", "db1:3306"},
+		{"unix(/tmp/mysql.sock)", "unix", "/tmp/mysql.sock"},
+	}
+	for _, tt := range tests {
+		net, addr := splitHost(tt.host)
+		assert.Equal(net, tt.net, tt.host)
+		assert.Equal(addr, tt.addr, tt.host)
+	}
+}
+
+func TestMysqlDSN(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := &Config{
+		User:   "user",
+		Pass:   "p@ss:w/rd?&=",
+		Params: map[string]string{"parseTime": "true", "charset": "utf8mb4"},
+	}
+
+	dsn, err := mysqlDSN{}.FormatDSN(c, "demoa", "tcp(db1:3306)")
+	require.NoError(err)
+	cfg, err := mysql.ParseDSN(dsn)
+	require.NoError(err)
+	assert.Equal(cfg.User, c.User)
+	assert.Equal(cfg.Passwd, c.Pass)
+	assert.Equal(cfg.Net, "tcp")
+	assert.Equal(cfg.Addr, "db1:3306")
+	assert.Equal(cfg.DBName, "demoa")
+	assert.True(cfg.ParseTime)
+	assert.Equal(cfg.Params, map[string]string{"charset": "utf8mb4"})
+
+	dsn, err = mysqlDSN{}.FormatDSN(c, "demoa", "unix(/tmp/mysql.sock)")
+	require.NoError(err)
+	cfg, err = mysql.ParseDSN(dsn)
+	require.NoError(err)
+	assert.Equal(cfg.Net, "unix")
+	assert.Equal(cfg.Addr, "/tmp/mysql.sock")
+
+	c.Params = map[string]string{"parseTime": "maybe"}
+	_, err = mysqlDSN{}.FormatDSN(c, "demoa", "tcp(db1:3306)")
+	assert.Error(err)
+}
+
+func TestPgxDSN(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := &Config{
+		User:   "user",
+		Pass:   "p@ss:w/rd?&=",
+		Params: map[string]string{"sslmode": "disable"},
+	}
+
+	dsn, err := pgxDSN{}.FormatDSN(c, "demoa", "db1:5433")
+	require.NoError(err)
+	cfg, err := pgx.ParseConfig(dsn)
+	require.NoError(err)
+	assert.Equal(cfg.User, c.User)
+	assert.Equal(cfg.Password, c.Pass)
+	assert.Equal(cfg.Host, "db1")
+	assert.Equal(cfg.Port, uint16(5433))
+	assert.Equal(cfg.Database, "demoa")
+	assert.Nil(cfg.TLSConfig)
+
+	dsn, err = pgxDSN{}.FormatDSN(c, "demoa", "unix(/var/run/postgresql)")
+	require.NoError(err)
+	cfg, err = pgx.ParseConfig(dsn)
+	require.NoError(err)
+	assert.Equal(cfg.Host, "/var/run/postgresql")
+
+	dsn, err = pgxDSN{}.FormatDSN(c, "demoa", "tcp(db2)")
+	require.NoError(err)
+	cfg, err = pgx.ParseConfig(dsn)
+	require.NoError(err)
+	assert.Equal(cfg.Host, "db2")
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// Default backoff after the first failure of opening [DB] of an app. Every
+	// next failure doubles it.
+	defFailureBackoff = time.Second
+
+	// Default max backoff after failures of opening [DB] of an app
+	defFailureMaxBackoff = 30 * time.Second
+)
+
+// newFailures creates and returns negative cache of failures. It's configured
+// by FailureBackoff, FailureMaxBackoff and Clock of dbConfig, zero values mean
+// defaults.
+func newFailures(dbConfig *Config) *failures {
+	f := &failures{
+		apps:       make(map[string]*failure),
+		clock:      dbConfig.clock(),
+		backoff:    defFailureBackoff,
+		maxBackoff: defFailureMaxBackoff,
+	}
+	if dbConfig.FailureBackoff > 0 {
+		f.backoff = dbConfig.FailureBackoff
+	}
+	if dbConfig.FailureMaxBackoff > 0 {
+		f.maxBackoff = dbConfig.FailureMaxBackoff
+	}
+	if f.maxBackoff < f.backoff {
+		f.maxBackoff = f.backoff
+	}
+	return f
+}
+
+// failures is negative cache of apps, which [DB] we failed to open. While an
+// app is in backoff, we return its last error without trying to open its
+// [DB] again. It's safe to call its methods from different goroutines.
+type failures struct {
+	apps map[string]*failure // key is appID
+	mu   sync.Mutex
+
+	backoff    time.Duration // backoff after the first failure
+	maxBackoff time.Duration // max backoff after many failures
+	clock      Clock
+}
+
+// failure is the last failure of opening [DB] of an app
+type failure struct {
+	err      error     // last error
+	attempts int       // number of failures in a row
+	retryAt  time.Time // we don't try again until this time
+}
+
+// err returns the last error of appID, if it's in backoff, or nil.
+func (self *failures) err(appID string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if f, ok := self.apps[appID]; ok && self.clock.Now().Before(f.retryAt) {
+		return f.err
+	}
+	return nil
+}
+
+// report remembers result of opening [DB] of appID. nil err forgets previous
+// failures of appID. Else it puts appID into backoff, which is doubled after
+// every failure in a row, up to maxBackoff. Errors, which don't depend on the
+// app, like [ErrOverloaded], are ignored.
+func (self *failures) report(appID string, err error) {
+	if errors.Is(err, ErrOverloaded) || errors.Is(err, ErrClosed) {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if err == nil {
+		delete(self.apps, appID)
+		return
+	}
+
+	now := self.clock.Now()
+	self.forgetOld(now)
+	f, ok := self.apps[appID]
+	if !ok {
+		f = &failure{}
+		self.apps[appID] = f
+	}
+	f.err = err
+	f.attempts++
+	f.retryAt = now.Add(self.backoffOf(f.attempts))
+}
+
+// backoffOf returns backoff after attempts failures in a row
+func (self *failures) backoffOf(attempts int) time.Duration {
+	d := self.backoff
+	for i := 1; i < attempts && d < self.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > self.maxBackoff {
+		d = self.maxBackoff
+	}
+	return d
+}
+
+// forgetOld forgets failures, which backoff ended more than maxBackoff ago. We
+// don't keep them forever and the next failure of these apps starts from the
+// first backoff again. Should be called under lock.
+func (self *failures) forgetOld(now time.Time) {
+	for appID, f := range self.apps {
+		if now.Sub(f.retryAt) > self.maxBackoff {
+			delete(self.apps, appID)
+		}
+	}
+}
+
+// clear forgets failures of appID and returns true if appID had them.
+func (self *failures) clear(appID string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	_, ok := self.apps[appID]
+	delete(self.apps, appID)
+	return ok
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFailures(&Config{})
+	assert.Equal(f.backoff, defFailureBackoff)
+	assert.Equal(f.maxBackoff, defFailureMaxBackoff)
+
+	f = newFailures(&Config{FailureBackoff: time.Minute})
+	assert.Equal(f.backoff, time.Minute)
+	assert.Equal(f.maxBackoff, time.Minute)
+}
+
+func TestBackoffOf(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFailures(&Config{})
+	assert.Equal(f.backoffOf(1), time.Second)
+	assert.Equal(f.backoffOf(2), 2*time.Second)
+	assert.Equal(f.backoffOf(5), 16*time.Second)
+	assert.Equal(f.backoffOf(6), 30*time.Second)
+	assert.Equal(f.backoffOf(1000), 30*time.Second)
+}
+
+func TestFailures(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	clock := newFakeClock()
+	f := newFailures(&Config{Clock: clock})
+	assert.NoError(f.err("demoa"))
+
+	err := errors.New("connection refused")
+	f.report("demoa", err)
+	assert.Same(f.err("demoa"), err)
+	assert.NoError(f.err("demob"))
+	f.report("demoa", err)
+	require.Contains(f.apps, "demoa")
+	assert.Equal(f.apps["demoa"].attempts, 2)
+
+	clock.Advance(f.backoffOf(2) - time.Nanosecond)
+	assert.Same(f.err("demoa"), err)
+	// backoff ended
+	clock.Advance(time.Nanosecond)
+	assert.NoError(f.err("demoa"))
+
+	f.report("demoa", nil)
+	assert.NotContains(f.apps, "demoa")
+
+	f.report("demoa", fmt.Errorf("open: %w", ErrOverloaded))
+	f.report("demoa", ErrClosed)
+	assert.NotContains(f.apps, "demoa")
+
+	f.report("demoa", err)
+	assert.True(f.clear("demoa"))
+	assert.False(f.clear("demoa"))
+	assert.NoError(f.err("demoa"))
+}
+
+func TestFailuresForgetOld(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	f := newFailures(&Config{Clock: clock})
+	err := errors.New("connection refused")
+	f.report("demoa", err)
+	clock.Advance(f.backoffOf(1) + f.maxBackoff + time.Nanosecond)
+
+	f.report("demob", err)
+	assert.NotContains(f.apps, "demoa")
+	assert.Contains(f.apps, "demob")
+}
+
+func TestDBFailure(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	host := fmt.Sprintf("tcp(%s)", l.Addr())
+	r.NoError(l.Close())
+
+	m := newTestMgr(t, Config{
+		Driver:         "mysql",
+		HostRW:         host,
+		PingTimeout:    time.Second,
+		FailureBackoff: time.Minute,
+	})
+
+	_, err = m.DB("demoa")
+	r.ErrorIs(err, ErrUnreachable)
+	a.Zero(m.openPools)
+
+	// the same error without new attempt
+	_, err2 := m.DB("demoa")
+	a.Same(err2, err)
+
+	m.dbConfig.HostRW = "tcp(127.0.0.1)"
+	m.dbConfig.PingTimeout = 0
+	_, err2 = m.DB("demoa")
+	a.Same(err2, err)
+
+	a.True(m.ClearFailure("demoa"))
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Equal(lease.DB().AppID(), "demoa")
+	a.NotContains(m.failures.apps, "demoa")
+}
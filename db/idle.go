@@ -1,85 +1,157 @@
 package db
 
 import (
+	"container/heap"
 	"container/list"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
 
 const (
-	// Default interval between expiration loops in [time.Duration]. How often we
-	// are executing the expiration loop.
-	defExpirationInterval = 45 * time.Second
+	// Default min interval between expiration loops in [time.Duration]. We
+	// don't wake up more often, even if idle [DB] expire more often, so we close
+	// them in batches.
+	defExpirationInterval = time.Second
 
-	// Default jitter for [defExpirationInterval] in seconds. We add random num of
-	// seconds to the interval before each sleep in the expiration loop.
-	defExpirationJitter = 30
+	// Default jitter for [defExpirationInterval] in [time.Duration]. We add
+	// random duration less than jitter to the interval before each sleep in the
+	// expiration loop.
+	defExpirationJitter = 5 * time.Second
 
 	// Default Time-To-Life for idle entries in [time.Duration]. Every idle [DB]
 	// will be closed after max TTL in this state.
 	defMaxTTL = 5 * time.Minute
 )
 
-// idleMgrRunner is the interface what wraps the run method.
-//
-// run launches forever loop, which cleanups idle DBs and sleeps between
-// cleanups.
-type idleMgrRunner interface {
-	run()
-}
-
-// goIdleMgr launches a goroutine with the run method of idleMgr. We are
-// modifying it in tests.
-var goIdleMgr = func(m idleMgrRunner) {
-	go m.run()
-}
-
 // newIdleMgr creates, initializes and returns manager, which keeps and handles
-// idle [DB]. This manager is thread-safe.
-func newIdleMgr() *idleMgr {
+// idle [DB], and launches its expiration loop. This manager is thread-safe.
+// It's configured by IdleTTL, IdleInterval, IdleJitter, MaxIdleDBs, Clock and
+// Rand of dbConfig, zero values mean defaults and negative IdleJitter means no
+// jitter. onClose is optional function, which is called after idle [DB] was
+// closed.
+func newIdleMgr(dbConfig *Config,
+	onClose func(db *DB, op string, err error)) *idleMgr {
 	m := &idleMgr{
 		idleList:    list.New(),
 		idleMap:     make(map[string]*list.Element),
 		expInterval: defExpirationInterval,
 		expJitter:   defExpirationJitter,
 		maxTTL:      defMaxTTL,
+		maxIdle:     dbConfig.MaxIdleDBs,
+		onClose:     onClose,
+		clock:       dbConfig.clock(),
+		int63n:      dbConfig.Rand,
+		stopCh:      make(chan struct{}),
+		wakeCh:      make(chan struct{}, 1),
 	}
-	goIdleMgr(m)
+	if dbConfig.IdleInterval > 0 {
+		m.expInterval = dbConfig.IdleInterval
+	}
+	if dbConfig.IdleJitter > 0 {
+		m.expJitter = dbConfig.IdleJitter
+	} else if dbConfig.IdleJitter < 0 {
+		m.expJitter = 0
+	}
+	if dbConfig.IdleTTL > 0 {
+		m.maxTTL = dbConfig.IdleTTL
+	}
+	if m.int63n == nil {
+		m.int63n = rand.Int63n
+	}
+	go m.run()
 	return m
 }
 
 // idleMgr is manager of idle [DB]. Its methods can be called from different
-// goroutines. It keeps [DB] nobody uses for [maxTTL] time and closes it if
-// nobody asked before.
+// goroutines. It keeps [DB] nobody uses for [maxTTL] time, or TTL of its app,
+// and closes it if nobody asked before.
 type idleMgr struct {
-	// List of idle [DB] ordered from fresh to old. If last element is not enough
-	// old according to [maxTTL], it means every item before is not reached
-	// [maxTTL] too.
+	// List of idle [DB] ordered from fresh to old, by time when they became
+	// idle, or by last use time after warm-up, see sortByLastUse. Because every
+	// app can have its own TTL, it isn't ordered by expiration time.
 	idleList *list.List
 
+	// The same idle [DB] in heap ordered by expiration time, so we find the
+	// next expiring one quickly.
+	expHeap expHeap
+
 	// Just a map between appID and its [DB] for faster access
 	idleMap map[string]*list.Element
 
-	// Interval between expiration loops
+	// Min interval between expiration loops
 	expInterval time.Duration
 
-	// Jitter, which we use to add random numbers of seconds to expiration
-	// interval on every iteration of the expiration loop.
-	expJitter int
+	// Jitter, which we use to add random duration to expiration interval on
+	// every iteration of the expiration loop.
+	expJitter time.Duration
 
-	// Max Time-To-Life of idle [DB]. If nobody will get it, we'll close it.
+	// Max Time-To-Life of idle [DB], if its app hasn't own TTL. If nobody will
+	// get it, we'll close it.
 	maxTTL time.Duration
 
+	// Max number of idle [DB]. If we have more, we close the oldest ones
+	// immediately. Zero means unlimited.
+	maxIdle int
+
+	// Optional function, which is called after idle [DB] was closed. op is
+	// reason of closing like in closeDB and err is error of closing or nil.
+	onClose func(db *DB, op string, err error)
+
+	// Source of time for expiration
+	clock Clock
+	// Source of random jitter, see [Config.Rand]
+	int63n func(n int64) int64
+
+	// Closing of stopCh stops the expiration loop
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// Wakes up the expiration loop, when new idle [DB] added
+	wakeCh chan struct{}
+
 	mu sync.RWMutex
 }
 
-// idleDB is a Value of [list.Element]. We are saving here pointer to [DB] and
-// expiration time.
+// idleDB is a Value of [list.Element] and an item of [expHeap]. We are saving
+// here pointer to [DB] and expiration time.
 type idleDB struct {
 	db       *DB
 	expireAt time.Time
+	index    int // index in expHeap
+}
+
+// expHeap implements [heap.Interface] for idle [DB] ordered by expiration
+// time, the first one expires first.
+type expHeap []*idleDB
+
+func (self expHeap) Len() int {
+	return len(self)
+}
+
+func (self expHeap) Less(i, j int) bool {
+	return self[i].expireAt.Before(self[j].expireAt)
+}
+
+func (self expHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *expHeap) Push(x any) {
+	idle := x.(*idleDB)
+	idle.index = len(*self)
+	*self = append(*self, idle)
+}
+
+func (self *expHeap) Pop() any {
+	old := *self
+	idle := old[len(old)-1]
+	old[len(old)-1] = nil
+	*self = old[:len(old)-1]
+	return idle
 }
 
 // onIdle returns true if idleMgr contains [DB] for appID. It means appID's DB
@@ -101,10 +173,7 @@ func (self *idleMgr) AppDB(appID string) *DB {
 		self.mu.Lock()
 		defer self.mu.Unlock()
 		if elem, ok := self.idleMap[appID]; ok {
-			idle := elem.Value.(idleDB)
-			delete(self.idleMap, appID)
-			self.idleList.Remove(elem)
-			return idle.db
+			return self.remove(elem)
 		}
 	} else {
 		self.mu.RUnlock()
@@ -113,59 +182,240 @@ func (self *idleMgr) AppDB(appID string) *DB {
 	return nil
 }
 
-// idleAppDB adds db into idleMgr and marks it for expiration after maxTTL. It
-// adds db into front of the list and it guaranties us the list is always sorted
-// from freshest to oldest.
-func (self *idleMgr) idleAppDB(db *DB) {
+// idleAppDB adds db into idleMgr and marks it for expiration after TTL of its
+// app or maxTTL. It adds db into front of the list and it guaranties us the
+// list is always sorted from freshest to oldest.
+//
+// If idleMgr has more than maxIdle DBs after that, it removes the oldest ones
+// and returns them. Caller should close them by closeDB, after it unlocked
+// everything, because closeDB calls onClose.
+func (self *idleMgr) idleAppDB(db *DB) []*DB {
+	var evicted []*DB
+
 	self.mu.Lock()
 	defer self.mu.Unlock()
+	defer self.wake()
 
 	appID := db.AppID()
-	ttl := time.Now().UTC().Add(self.maxTTL)
+	ttl := self.clock.Now().UTC().Add(self.ttl(db))
 	if elem, ok := self.idleMap[appID]; ok {
-		idle := elem.Value.(idleDB)
-		idle.expireAt = ttl
+		idle := elem.Value.(*idleDB)
+		if idle.db != db {
+			evicted = append(evicted, idle.db)
+		}
+		idle.db, idle.expireAt = db, ttl
+		heap.Fix(&self.expHeap, idle.index)
+		self.idleList.MoveToFront(elem)
 	} else {
-		elem = self.idleList.PushFront(idleDB{db, ttl})
-		self.idleMap[appID] = elem
+		idle := &idleDB{db: db, expireAt: ttl}
+		heap.Push(&self.expHeap, idle)
+		self.idleMap[appID] = self.idleList.PushFront(idle)
+	}
+
+	for self.maxIdle > 0 && self.idleList.Len() > self.maxIdle {
+		evicted = append(evicted, self.remove(self.idleList.Back()))
+	}
+
+	return evicted
+}
+
+// ttl returns TTL of idle db: TTL of its app, if it has own TTL, or maxTTL.
+func (self *idleMgr) ttl(db *DB) time.Duration {
+	if db.idleTTL > 0 {
+		return db.idleTTL
 	}
+	return self.maxTTL
 }
 
-// run starts the expiration loop. On every iteration it sleeps for expInterval
-// + random number of seconds, defined by expJitter. Works in separate goroutine
-// and fired from newIdleMgr.
+// run starts the expiration loop. It sleeps until the first idle DB expires,
+// but at least expInterval since the previous expiration, + random duration,
+// defined by expJitter. If we have no idle DB, it sleeps until idleAppDB wakes
+// it up. Wake up never postpones the timer, it only can fire it sooner, so
+// frequent wakes can't delay expiration. Works in separate goroutine and fired
+// from newIdleMgr. It returns after stop was called.
 func (self *idleMgr) run() {
+	timer := self.clock.NewTimer(time.Hour)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	// due is when we should call expire, deadline is due + jitter, when the
+	// timer fires. Both are zero, if the timer isn't armed.
+	var due, deadline, lastExpire time.Time
 	for {
-		time.Sleep(self.sleepTime())
-		self.expire()
+		if at, ok := self.expireTime(lastExpire); !ok {
+			stopTimer(timer)
+			due, deadline = time.Time{}, time.Time{}
+		} else if due.IsZero() || at.Before(due) {
+			due = at
+			at = at.Add(self.jitter())
+			if deadline.IsZero() || at.Before(deadline) {
+				deadline = at
+				stopTimer(timer)
+				timer.Reset(deadline.Sub(self.clock.Now()))
+			}
+		}
+
+		select {
+		case <-timer.C():
+			self.expire()
+			lastExpire = self.clock.Now()
+			due, deadline = time.Time{}, time.Time{}
+		case <-self.wakeCh:
+		case <-self.stopCh:
+			return
+		}
+	}
+}
+
+// wake wakes up the expiration loop, so it recalculates its sleep time. It
+// never blocks.
+func (self *idleMgr) wake() {
+	select {
+	case self.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops the expiration loop. It's safe to call it more than once.
+func (self *idleMgr) stop() {
+	self.stopOnce.Do(func() { close(self.stopCh) })
+}
+
+// closeAll closes and removes all idle DB. It returns the first error of
+// closing, if any, or nil.
+func (self *idleMgr) closeAll() error {
+	self.mu.Lock()
+	all := make([]*DB, 0, self.idleList.Len())
+	for elem := self.idleList.Back(); elem != nil; elem = self.idleList.Back() {
+		all = append(all, self.remove(elem))
 	}
+	self.mu.Unlock()
+
+	var firstErr error
+	for _, db := range all {
+		if err := self.closeDB(db, "close"); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-// sleepTime returns current sleep time before calling the expire method. Every
-// call returns expInterval + some random num of seconds < expJitter.
-func (self *idleMgr) sleepTime() time.Duration {
-	jitter := time.Duration(rand.Intn(self.expJitter) * int(time.Second))
-	return self.expInterval + jitter
+// expireTime returns time, when we should call the expire method, and true.
+// It's time when the first idle DB expires, but at least expInterval after
+// lastExpire, time of the previous call of expire. If we have no idle DB, it
+// returns false.
+func (self *idleMgr) expireTime(lastExpire time.Time) (time.Time, bool) {
+	self.mu.RLock()
+	if len(self.expHeap) == 0 {
+		self.mu.RUnlock()
+		return time.Time{}, false
+	}
+	expireAt := self.expHeap[0].expireAt
+	self.mu.RUnlock()
+
+	if minAt := lastExpire.Add(self.expInterval); expireAt.Before(minAt) {
+		expireAt = minAt
+	}
+	return expireAt, true
+}
+
+// jitter returns random duration < expJitter, which we add to sleep time of
+// the expiration loop.
+func (self *idleMgr) jitter() time.Duration {
+	if self.expJitter > 0 {
+		return time.Duration(self.int63n(int64(self.expJitter)))
+	}
+	return 0
 }
 
-// expire closes and removes all DB with expireAt before now. Because our list
-// by nature sorted from freshest to oldest, we can stop our loop as soon as the
-// last element is fresh enough.
+// expire closes and removes all DB with expireAt before now. It takes them
+// from the top of expHeap, so it doesn't check DB, which don't expire yet.
 func (self *idleMgr) expire() {
+	var expired []*DB
+
+	self.mu.Lock()
+	now := self.clock.Now().UTC()
+	for len(self.expHeap) > 0 && !self.expHeap[0].expireAt.After(now) {
+		elem := self.idleMap[self.expHeap[0].db.AppID()]
+		expired = append(expired, self.remove(elem))
+	}
+	self.mu.Unlock()
+
+	for _, db := range expired {
+		self.closeDB(db, "expire")
+	}
+}
+
+// evictOldest closes and removes the oldest idle DB, before its expiration.
+// Returns closed DB or nil if idleMgr is empty and error of closing or nil. It
+// doesn't call onClose, because caller is responsible for it.
+func (self *idleMgr) evictOldest() (*DB, error) {
+	self.mu.Lock()
+	elem := self.idleList.Back()
+	if elem == nil {
+		self.mu.Unlock()
+		return nil, nil
+	}
+	db := self.remove(elem)
+	self.mu.Unlock()
+
+	err := db.close()
+	if err != nil {
+		log.Printf("evict: close idle DB pool(%v): %v\n", db.AppID(), err)
+	}
+	return db, err
+}
+
+// remove removes elem from idleMgr and returns its DB. Should be called with
+// locked mu.
+func (self *idleMgr) remove(elem *list.Element) *DB {
+	idle := elem.Value.(*idleDB)
+	delete(self.idleMap, idle.db.AppID())
+	self.idleList.Remove(elem)
+	heap.Remove(&self.expHeap, idle.index)
+	return idle.db
+}
+
+// closeDB closes db, which was removed from idleMgr, and calls onClose. op is
+// name of operation for logging. Returns error of closing, if any, or nil.
+func (self *idleMgr) closeDB(db *DB, op string) error {
+	err := db.close()
+	if err != nil {
+		log.Printf("%v: close idle DB pool(%v): %v\n", op, db.AppID(), err)
+	}
+	if self.onClose != nil {
+		self.onClose(db, op, err)
+	}
+	return err
+}
+
+// each calls fn for every idle DB. fn shouldn't call methods of idleMgr.
+func (self *idleMgr) each(fn func(db *DB)) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for elem := self.idleList.Front(); elem != nil; elem = elem.Next() {
+		fn(elem.Value.(*idleDB).db)
+	}
+}
+
+// sortByLastUse orders idle DB by last use time of their apps from freshest to
+// oldest, so the least recently used ones are evicted first. Expiration times
+// aren't changed.
+func (self *idleMgr) sortByLastUse() {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
-	now := time.Now().UTC()
-	for elem := self.idleList.Back(); elem != nil; elem = self.idleList.Back() {
-		idle := elem.Value.(idleDB)
-		if idle.expireAt.After(now) {
-			return
-		}
-		db := idle.db
-		delete(self.idleMap, db.AppID())
-		self.idleList.Remove(elem)
-		if err := db.close(); err != nil {
-			log.Printf("expire: close idle DB pool(%v): %v\n", db.AppID(), err)
+	elems := make([]*list.Element, 0, self.idleList.Len())
+	for elem := self.idleList.Front(); elem != nil; elem = elem.Next() {
+		elems = append(elems, elem)
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		lastUse := func(elem *list.Element) time.Time {
+			return elem.Value.(*idleDB).db.stats.lastUseTime()
 		}
+		return lastUse(elems[i]).After(lastUse(elems[j]))
+	})
+	for _, elem := range elems {
+		self.idleList.MoveToBack(elem)
 	}
 }
@@ -1,7 +1,7 @@
 package db
 
 import (
-	"math/rand"
+	"fmt"
 	"testing"
 	"time"
 
@@ -9,56 +9,50 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-type TestIdleMgrRunner struct {
-	// Closing of closeCh means we've done
-	closeCh chan struct{}
-	// number of calls of the run method
-	cnt int
+// newTestIdleMgr creates idleMgr configured by c with fakeClock and returns
+// them. Its expiration loop runs, until the test ends, but idle DB don't
+// expire, until the test advances the clock.
+func newTestIdleMgr(t testing.TB, c *Config) (*idleMgr, *fakeClock) {
+	clock := newFakeClock()
+	c.Clock = clock
+	m := newIdleMgr(c, nil)
+	t.Cleanup(m.stop)
+	return m, clock
 }
 
-// fake run method
-func (self *TestIdleMgrRunner) run() {
-	self.cnt++
-	close(self.closeCh)
-}
+func TestNewIdleMgr(t *testing.T) {
+	assert := assert.New(t)
 
-func withTestIdleMgr(t *testing.T) {
-	orig := goIdleMgr
-	t.Cleanup(func() { goIdleMgr = orig })
-	goIdleMgr = func(m idleMgrRunner) {}
+	m, _ := newTestIdleMgr(t, &Config{})
+	assert.Equal(m.expInterval, defExpirationInterval)
+	assert.Equal(m.expJitter, defExpirationJitter)
+	assert.Equal(m.maxTTL, defMaxTTL)
 }
 
-func TestNewIdleMgr(t *testing.T) {
+func TestNewIdleMgrConfig(t *testing.T) {
 	assert := assert.New(t)
-	require := require.New(t)
 
-	orig := goIdleMgr
-	withTestIdleMgr(t)
-	testRunner := &TestIdleMgrRunner{
-		closeCh: make(chan struct{}),
-	}
-	goIdleMgr = func(m idleMgrRunner) { orig(testRunner) }
-	m := newIdleMgr()
-	require.NotNil(m)
+	m, _ := newTestIdleMgr(t, &Config{
+		MaxIdleDBs:   10,
+		IdleTTL:      time.Minute,
+		IdleInterval: 2 * time.Second,
+		IdleJitter:   3 * time.Second,
+	})
 
-	select {
-	case <-testRunner.closeCh:
-	case <-time.After(time.Second):
-		assert.FailNow("run() method wasn't called")
-	}
-	assert.Equal(testRunner.cnt, 1)
+	assert.Equal(m.maxIdle, 10)
+	assert.Equal(m.maxTTL, time.Minute)
+	assert.Equal(m.expInterval, 2*time.Second)
+	assert.Equal(m.expJitter, 3*time.Second)
 
-	assert.Equal(m.expInterval, defExpirationInterval)
-	assert.Equal(m.expJitter, defExpirationJitter)
-	assert.Equal(m.maxTTL, defMaxTTL)
+	m, _ = newTestIdleMgr(t, &Config{IdleJitter: -1})
+	assert.Zero(m.expJitter)
 }
 
 func TestOnIdle(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	withTestIdleMgr(t)
-	m := newIdleMgr()
+	m, _ := newTestIdleMgr(t, &Config{})
 	require.NotNil(m)
 
 	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
@@ -72,43 +66,356 @@ func TestOnIdle(t *testing.T) {
 	assert.False(m.onIdle(db.AppID()))
 }
 
-func TestSleepTime(t *testing.T) {
+func TestExpireTime(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
-	expInt, _ := time.ParseDuration("45s")
-	m := &idleMgr{
-		expInterval: expInt,
-		expJitter:   30,
-	}
-	rand.Seed(time.Now().UnixNano())
-	sleepTime := m.sleepTime()
-	assert.GreaterOrEqual(sleepTime, m.expInterval)
+	m, clock := newTestIdleMgr(t, &Config{IdleInterval: 45 * time.Second})
 
-	max, _ := time.ParseDuration("1m15s")
-	assert.Less(sleepTime, max)
+	_, ok := m.expireTime(time.Time{})
+	assert.False(ok, "expire time without idle DB")
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
+
+	start := clock.Now()
+	m.idleAppDB(db)
+	expireAt, ok := m.expireTime(time.Time{})
+	require.True(ok)
+	assert.Equal(expireAt, start.Add(defMaxTTL))
+
+	// expires sooner than expInterval after the previous expiration
+	lastExpire := start.Add(defMaxTTL - time.Second)
+	expireAt, ok = m.expireTime(lastExpire)
+	require.True(ok)
+	assert.Equal(expireAt, lastExpire.Add(45*time.Second))
+
+	// expires later than expInterval after the previous expiration
+	expireAt, ok = m.expireTime(start)
+	require.True(ok)
+	assert.Equal(expireAt, start.Add(defMaxTTL))
 }
 
 func TestExpire(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	withTestIdleMgr(t)
-	m := newIdleMgr()
+	m, clock := newTestIdleMgr(t, &Config{})
 	require.NotNil(m)
 
 	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
 	db, err := newDB("demoa", c)
 	require.NoError(err)
 
-	m.maxTTL = 0
 	m.idleAppDB(db)
+	clock.Advance(defMaxTTL - time.Nanosecond)
+	m.expire()
 	assert.True(m.onIdle(db.AppID()))
+
+	clock.Advance(time.Nanosecond)
 	m.expire()
 	assert.False(m.onIdle(db.AppID()))
+}
+
+func TestExpireAppTTL(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{IdleInterval: time.Second})
+
+	c := &Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Apps:   map[string]AppConfig{"demob": {IdleTTL: time.Minute}},
+	}
+	dba, err := newDB("demoa", c.appConfig("demoa"))
+	require.NoError(err)
+	dbb, err := newDB("demob", c.appConfig("demob"))
+	require.NoError(err)
+
+	// demob is fresher, but expires before demoa
+	m.idleAppDB(dba)
+	m.idleAppDB(dbb)
+	start := clock.Now()
+	expireAt, ok := m.expireTime(time.Time{})
+	require.True(ok)
+	assert.Equal(expireAt, start.Add(time.Minute))
+
+	clock.Advance(time.Minute)
+	m.expire()
+	assert.True(m.onIdle("demoa"))
+	assert.False(m.onIdle("demob"))
+
+	expireAt, ok = m.expireTime(clock.Now())
+	require.True(ok)
+	assert.Equal(expireAt, start.Add(defMaxTTL))
+}
+
+func TestExpHeap(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{})
+
+	c := &Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Apps:   make(map[string]AppConfig),
+	}
+	dbs := make([]*DB, 5)
+	for i := range dbs {
+		appID := fmt.Sprintf("demo%d", i)
+		c.Apps[appID] = AppConfig{IdleTTL: time.Duration(5-i) * time.Minute}
+		db, err := newDB(appID, c.appConfig(appID))
+		require.NoError(err)
+		m.idleAppDB(db)
+		dbs[i] = db
+	}
+	// the freshest demo4 expires first
+	assert.Same(m.expHeap[0].db, dbs[4])
+
+	// demo4 expires after demo3 now
+	clock.Advance(90 * time.Second)
+	m.idleAppDB(dbs[4])
+	m.AppDB("demo2")
+	require.Len(m.expHeap, 4)
+	for i, idle := range m.expHeap {
+		assert.Equal(idle.index, i)
+	}
+
+	var expired []string
+	seen := make(map[string]bool)
+	for i := 0; i < 10 && m.idleList.Len() > 0; i++ {
+		clock.Advance(30 * time.Second)
+		m.expire()
+		for _, appID := range []string{"demo0", "demo1", "demo3", "demo4"} {
+			if !m.onIdle(appID) && !seen[appID] {
+				seen[appID] = true
+				expired = append(expired, appID)
+			}
+		}
+	}
+	assert.Equal(expired, []string{"demo3", "demo4", "demo1", "demo0"})
+	assert.Empty(m.expHeap)
+}
+
+func TestIdleAppDBLRU(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, _ := newTestIdleMgr(t, &Config{MaxIdleDBs: 2})
+	var closed []string
+	m.onClose = func(db *DB, op string, err error) {
+		closed = append(closed, db.AppID())
+	}
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	dbs := make([]*DB, 3)
+	for i, appID := range []string{"demoa", "demob", "democ"} {
+		db, err := newDB(appID, c)
+		require.NoError(err)
+		dbs[i] = db
+	}
+
+	assert.Empty(m.idleAppDB(dbs[0]))
+	assert.Empty(m.idleAppDB(dbs[1]))
+	// demoa is fresher than demob now
+	assert.Empty(m.idleAppDB(dbs[0]))
+
+	evicted := m.idleAppDB(dbs[2])
+	require.Len(evicted, 1)
+	assert.Same(evicted[0], dbs[1])
+	assert.False(m.onIdle("demob"))
+	assert.True(m.onIdle("demoa"))
+	assert.True(m.onIdle("democ"))
+
+	m.closeDB(evicted[0], "evict")
+	assert.Nil(dbs[1].RW())
+	assert.Equal(closed, []string{"demob"})
+}
+
+func TestIdleAppDBReplace(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, _ := newTestIdleMgr(t, &Config{})
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db1, err := newDB("demoa", c)
+	require.NoError(err)
+	db2, err := newDB("demoa", c)
+	require.NoError(err)
+
+	assert.Empty(m.idleAppDB(db1))
+	assert.Equal(m.idleAppDB(db2), []*DB{db1})
+	assert.Same(m.AppDB("demoa"), db2)
+}
+
+func TestIdleAppDBRefreshTTL(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{})
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
 
-	m.maxTTL = time.Minute
 	m.idleAppDB(db)
-	assert.True(m.onIdle(db.AppID()))
+	clock.Advance(time.Minute)
+	m.idleAppDB(db)
+	clock.Advance(defMaxTTL - time.Minute)
 	m.expire()
-	assert.True(m.onIdle(db.AppID()))
+	assert.True(m.onIdle("demoa"), "TTL wasn't refreshed")
+}
+
+func TestIdleMgrStop(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, _ := newTestIdleMgr(t, &Config{})
+	require.NotNil(m)
+
+	done := make(chan struct{})
+	go func() {
+		m.run()
+		close(done)
+	}()
+
+	m.stop()
+	m.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.FailNow("run() didn't return after stop()")
+	}
+}
+
+func TestIdleMgrCloseAll(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, _ := newTestIdleMgr(t, &Config{})
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	var closed []string
+	m.onClose = func(db *DB, op string, err error) {
+		closed = append(closed, db.AppID())
+	}
+	for _, appID := range []string{"demoa", "demob"} {
+		db, err := newDB(appID, c)
+		require.NoError(err)
+		m.idleAppDB(db)
+	}
+
+	require.NoError(m.closeAll())
+	assert.Zero(m.idleList.Len())
+	assert.Empty(m.idleMap)
+	assert.Empty(m.expHeap)
+	assert.ElementsMatch(closed, []string{"demoa", "demob"})
+}
+
+func TestIdleMgrRun(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{
+		IdleTTL:    time.Minute,
+		IdleJitter: -1, // no jitter
+	})
+	closed := make(chan string, 1)
+	m.onClose = func(db *DB, op string, err error) { closed <- op }
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
+	m.idleAppDB(db)
+
+	// the loop sleeps until db expires
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Minute - time.Nanosecond)
+	assert.True(m.onIdle("demoa"))
+	clock.Advance(time.Nanosecond)
+
+	select {
+	case op := <-closed:
+		assert.Equal(op, "expire")
+		assert.False(m.onIdle("demoa"))
+		assert.Nil(db.RW())
+	case <-time.After(time.Second):
+		assert.FailNow("idle DB wasn't expired")
+	}
+}
+
+func TestIdleMgrRunJitter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{
+		IdleTTL:    time.Minute,
+		IdleJitter: 10 * time.Second,
+		Rand:       func(n int64) int64 { return n / 2 },
+	})
+	closed := make(chan string, 1)
+	m.onClose = func(db *DB, op string, err error) { closed <- op }
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
+	m.idleAppDB(db)
+
+	// the loop sleeps until db expires + jitter
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Minute + 5*time.Second - time.Nanosecond)
+	select {
+	case <-closed:
+		assert.FailNow("idle DB was expired before jitter")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.True(m.onIdle("demoa"))
+	clock.Advance(time.Nanosecond)
+
+	select {
+	case op := <-closed:
+		assert.Equal(op, "expire")
+		assert.False(m.onIdle("demoa"))
+	case <-time.After(time.Second):
+		assert.FailNow("idle DB wasn't expired")
+	}
+}
+
+func TestIdleMgrRunWake(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m, clock := newTestIdleMgr(t, &Config{
+		IdleTTL:      time.Minute,
+		IdleInterval: 30 * time.Second,
+		IdleJitter:   -1, // no jitter
+	})
+	closed := make(chan string, 10)
+	m.onClose = func(db *DB, op string, err error) { closed <- db.AppID() }
+
+	c := &Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"}
+	db, err := newDB("demoa", c)
+	require.NoError(err)
+	m.idleAppDB(db)
+	clock.waitTimers(t, 1)
+
+	// other DB become idle more often than expInterval, but they don't
+	// postpone expiration of demoa
+	for i := 0; i < 5; i++ {
+		clock.Advance(20 * time.Second)
+		db, err := newDB(fmt.Sprintf("demo%d", i), c)
+		require.NoError(err)
+		m.idleAppDB(db)
+	}
+
+	select {
+	case appID := <-closed:
+		assert.Equal(appID, "demoa")
+	case <-time.After(time.Second):
+		assert.FailNow("idle DB wasn't expired")
+	}
 }
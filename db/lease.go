@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Default duration of holding [Lease], after which we log a warning in debug
+// mode, see [Config.LeaseDebug].
+const defLeaseWarnAfter = 30 * time.Second
+
+// Lease is [DB] acquired from [Mgr] by [Mgr.DB]. [DB] can't become idle or be
+// closed, while it has active leases, except [Mgr.Close] with expired context.
+// Every Lease should be released by [Lease.Release], when we don't need its
+// [DB] anymore. It's safe to call its methods from different goroutines.
+type Lease struct {
+	mgr      *Mgr
+	db       *DB
+	released int32 // 1 after Release
+
+	// Who acquired this Lease, it's nil if debug mode is off
+	debug *leaseDebug
+}
+
+// leaseDebug describes who acquired [Lease] in debug mode
+type leaseDebug struct {
+	acquired time.Time
+	tag      LeaseTag
+	stack    string
+	// Logs warning, if [Lease] is held too long
+	warn Timer
+}
+
+// DB returns leased [DB]. It shouldn't be used after [Lease.Release].
+func (self *Lease) DB() *DB {
+	return self.db
+}
+
+// Release returns leased [DB] back into [Mgr]. If nobody else uses this [DB]
+// at this moment, it'll be put into an idle list and later will be closed, if
+// nobody else will request it before. Only the first call releases [DB], next
+// calls do nothing.
+func (self *Lease) Release() {
+	if atomic.CompareAndSwapInt32(&self.released, 0, 1) {
+		if self.debug != nil {
+			self.mgr.untrackLease(self)
+		}
+		self.mgr.release(self.db)
+	}
+}
+
+// LeaseTag describes who acquires [Lease], like HTTP route and ID of HTTP
+// request. It's recorded in debug mode, see [Config.LeaseDebug].
+type LeaseTag struct {
+	Route     string // pattern of HTTP route
+	RequestID string // ID of HTTP request
+}
+
+// leaseTagKey is key of [LeaseTag] in [context.Context]
+type leaseTagKey struct{}
+
+// WithLeaseTag returns copy of ctx with tag, which is recorded by
+// [Mgr.DBContext] in debug mode.
+func WithLeaseTag(ctx context.Context, tag LeaseTag) context.Context {
+	return context.WithValue(ctx, leaseTagKey{}, tag)
+}
+
+// leaseTagFrom returns [LeaseTag] from ctx or empty LeaseTag.
+func leaseTagFrom(ctx context.Context) LeaseTag {
+	tag, _ := ctx.Value(leaseTagKey{}).(LeaseTag)
+	return tag
+}
+
+// LeaseInfo describes outstanding [Lease], see [Mgr.Leases].
+type LeaseInfo struct {
+	AppID    string
+	Acquired time.Time     // when it was acquired
+	Held     time.Duration // how long it's held
+	LeaseTag               // who acquired it
+	Stack    string        // stack trace of acquiring
+}
+
+// newLease creates and returns [Lease] of db. db.refs should be already
+// increased. In debug mode it records who acquires it, using ctx.
+func (self *Mgr) newLease(ctx context.Context, db *DB) *Lease {
+	lease := &Lease{mgr: self, db: db}
+	if self.dbConfig.LeaseDebug {
+		self.trackLease(ctx, lease)
+	}
+	return lease
+}
+
+// trackLease records who acquires lease and starts timer, which logs warning,
+// if lease is held longer than [Config.LeaseWarnAfter].
+func (self *Mgr) trackLease(ctx context.Context, lease *Lease) {
+	warnAfter := self.dbConfig.LeaseWarnAfter
+	if warnAfter <= 0 {
+		warnAfter = defLeaseWarnAfter
+	}
+
+	info := &leaseDebug{
+		acquired: self.clock.Now(),
+		tag:      leaseTagFrom(ctx),
+		stack:    string(debug.Stack()),
+	}
+	lease.debug = info
+	appID := lease.db.AppID()
+	info.warn = self.clock.AfterFunc(warnAfter, func() {
+		log.Printf("db: lease of %v is held for %v, route %q, request %q, "+
+			"acquired at:\n%s", appID, self.clock.Now().Sub(info.acquired),
+			info.tag.Route, info.tag.RequestID, info.stack)
+	})
+
+	self.leasesMu.Lock()
+	self.leases[lease] = struct{}{}
+	self.leasesMu.Unlock()
+}
+
+// untrackLease forgets lease, recorded by trackLease.
+func (self *Mgr) untrackLease(lease *Lease) {
+	lease.debug.warn.Stop()
+	self.leasesMu.Lock()
+	delete(self.leases, lease)
+	self.leasesMu.Unlock()
+}
+
+// Leases returns outstanding leases per appID, ordered from oldest to freshest.
+// It returns nil if debug mode is off, see [Config.LeaseDebug].
+func (self *Mgr) Leases() map[string][]LeaseInfo {
+	if !self.dbConfig.LeaseDebug {
+		return nil
+	}
+
+	now := self.clock.Now()
+	leases := make(map[string][]LeaseInfo)
+	self.leasesMu.Lock()
+	for lease := range self.leases {
+		appID := lease.db.AppID()
+		leases[appID] = append(leases[appID], LeaseInfo{
+			AppID:    appID,
+			Acquired: lease.debug.acquired,
+			Held:     now.Sub(lease.debug.acquired),
+			LeaseTag: lease.debug.tag,
+			Stack:    lease.debug.stack,
+		})
+	}
+	self.leasesMu.Unlock()
+
+	for _, infos := range leases {
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Acquired.Before(infos[j].Acquired)
+		})
+	}
+	return leases
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseReleaseClosed(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	db := lease.DB()
+
+	closed := make(chan error)
+	go func() { closed <- m.Close(context.Background()) }()
+
+	// Close waits for the lease
+	a.Eventually(func() bool { return m.idle.idleList.Len() == 0 },
+		time.Second, time.Millisecond)
+	a.NotNil(db.RW())
+
+	lease.Release()
+	lease.Release()
+	r.NoError(<-closed)
+	a.Nil(db.RW(), "released DB isn't closed")
+}
+
+// TestLeaseStress leases and releases DB of a few apps from many goroutines,
+// while idle DB are expired and evicted, and checks no DB is closed while it's
+// leased. Run it with -race.
+func TestLeaseStress(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:       "mysql",
+		HostRW:       "tcp(127.0.0.1)",
+		MaxConns:     3,
+		MaxIdleDBs:   2,
+		IdleTTL:      time.Millisecond,
+		IdleInterval: time.Millisecond,
+		IdleJitter:   -1,
+		// idle DB are really expired, while we use them
+		Clock: realClock{},
+	})
+
+	var closedLeased, closedCnt int32
+	onClose := m.idle.onClose
+	m.idle.onClose = func(db *DB, op string, err error) {
+		if atomic.LoadInt32(&db.refs) > 0 {
+			atomic.AddInt32(&closedLeased, 1)
+		}
+		atomic.AddInt32(&closedCnt, 1)
+		onClose(db, op, err)
+	}
+
+	const (
+		goroutines = 16
+		iterations = 300
+	)
+	apps := []string{"demoa", "demob", "democ", "demod", "demoe"}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < iterations; j++ {
+				if err := leaseOnce(m, apps[rnd.Intn(len(apps))], rnd); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		r.NoError(err)
+	}
+
+	r.NoError(m.Close(context.Background()))
+	a.Zero(atomic.LoadInt32(&closedLeased), "DB closed while leased")
+	a.Positive(atomic.LoadInt32(&closedCnt))
+	a.Zero(m.numActive())
+	a.Zero(m.openPools)
+}
+
+// leaseOnce leases DB of appID from m, uses and releases it. Sometimes it gives
+// up waiting for DB.
+func leaseOnce(m *Mgr, appID string, rnd *rand.Rand) error {
+	ctx := context.Background()
+	if rnd.Intn(10) == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Microsecond)
+		defer cancel()
+	}
+
+	lease, err := m.DBContext(ctx, appID)
+	if errors.Is(err, ErrOverloaded) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	db := lease.DB()
+	if db.AppID() != appID {
+		return fmt.Errorf("leased DB of %q instead of %q", db.AppID(), appID)
+	}
+	for i := rnd.Intn(3); i >= 0; i-- {
+		if db.RW() == nil {
+			return fmt.Errorf("leased DB of %q is closed", appID)
+		}
+		runtime.Gosched()
+	}
+
+	lease.Release()
+	lease.Release()
+	return nil
+}
+
+func TestLeaseDebug(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Nil(lease.debug)
+	a.Nil(m.Leases())
+	lease.Release()
+
+	var logBuf safeBuffer
+	log.SetOutput(&logBuf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	clock := newFakeClock()
+	m = newTestMgr(t, Config{
+		Driver:         "mysql",
+		HostRW:         "tcp(127.0.0.1)",
+		LeaseDebug:     true,
+		LeaseWarnAfter: 2 * time.Minute,
+		Clock:          clock,
+	})
+	a.Empty(m.Leases())
+
+	ctx := WithLeaseTag(context.Background(),
+		LeaseTag{Route: "/{appID}/hello", RequestID: "req-1"})
+	lease, err = m.DBContext(ctx, "demoa")
+	r.NoError(err)
+	clock.Advance(time.Minute)
+	lease2, err := m.DB("demoa")
+	r.NoError(err)
+
+	leases := m.Leases()
+	r.Len(leases["demoa"], 2)
+	info := leases["demoa"][0]
+	a.Equal(info.AppID, "demoa")
+	a.Equal(info.LeaseTag, LeaseTag{Route: "/{appID}/hello", RequestID: "req-1"})
+	a.Contains(info.Stack, "TestLeaseDebug")
+	a.Equal(info.Held, time.Minute)
+	a.Equal(leases["demoa"][1].LeaseTag, LeaseTag{})
+	a.Zero(leases["demoa"][1].Held)
+
+	a.NotContains(logBuf.String(), "lease of demoa is held")
+	clock.Advance(time.Minute)
+	a.Contains(logBuf.String(), "lease of demoa is held for 2m0s, "+
+		`route "/{appID}/hello", request "req-1"`)
+	a.NotContains(logBuf.String(), `route "", request ""`)
+
+	lease.Release()
+	lease2.Release()
+	a.Empty(m.Leases())
+}
+
+// safeBuffer is [bytes.Buffer], which is safe for using from different
+// goroutines.
+type safeBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (self *safeBuffer) Write(p []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *safeBuffer) String() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.String()
+}
@@ -2,91 +2,417 @@
 //
 // It's safe to use it from goroutines.
 //
-// For any app we can request DB connections and manager will return it. When we
-// finished processing of request for this app, we should return its DB
-// connections back to the manager and if nobody else uses it at this moment,
-// the manager will put it into idle list and it'll be closed after some time,
-// if nobody will request it before.
+// For any app we can request DB connections and manager will return lease of
+// it. When we finished processing of request for this app, we should release
+// the lease and if nobody else uses its DB connections at this moment, the
+// manager will put them into idle list and they'll be closed after some time,
+// if nobody will request them before.
 package db
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/singleflight"
 )
 
+var (
+	// ErrOverloaded is returned by [Mgr.DB] when the global connection budget is
+	// exhausted and we can't open pools for one more app.
+	ErrOverloaded = errors.New("db: connection budget exhausted")
+
+	// ErrClosed is returned by [Mgr.DB] after [Mgr.Close] was called.
+	ErrClosed = errors.New("db: manager closed")
+)
+
+// closeWaitInterval is interval between checks, are all [DB] released, while
+// we are closing [Mgr], if nobody wakes it up before.
+const closeWaitInterval = 10 * time.Millisecond
+
 // NewMgr creates the manager and returns it. After that it's ready to use and
 // fully functional. Should be done once at the beginning.
 func NewMgr(dbConfig Config) *Mgr {
-	return &Mgr{
-		dbConfig: &dbConfig,
-		appDB:    make(map[string]*DB),
-		idle:     newIdleMgr(),
+	m := &Mgr{
+		dbConfig:  &dbConfig,
+		clock:     dbConfig.clock(),
+		shards:    newShards(dbConfig.Shards),
+		failures:  newFailures(&dbConfig),
+		leases:    make(map[*Lease]struct{}),
+		history:   make(map[string]appSnapshot),
+		snapStop:  make(chan struct{}),
+		closeWake: make(chan struct{}, 1),
+	}
+	m.idle = newIdleMgr(m.dbConfig, m.closedDB)
+
+	if dbConfig.SnapshotFile != "" {
+		if err := m.loadSnapshot(); err != nil {
+			log.Printf("db: load snapshot: %v", err)
+		}
+		m.snapWG.Add(1)
+		go func() {
+			defer m.snapWG.Done()
+			m.runSnapshots(m.snapStop)
+		}()
 	}
+	return m
 }
 
 // Mgr defines the manager. Use [NewMgr] for creating instance of Mgr.
 type Mgr struct {
 	dbConfig *Config // DB connection configuration
-	// Creates link between ID of app and pool of DB connections to its database
-	appDB map[string]*DB
-	idle  *idleMgr
-	mu    sync.RWMutex
-	sg    singleflight.Group
-}
-
-// DB returns [DB] pools for this appID. Also it returns error if any or
-// nil. When we don't need this DB anymore, it should be returned back to the
-// manager by [ReleaseDB].
-func (self *Mgr) DB(appID string) (*DB, error) {
-	self.mu.RLock()
-	if db, ok := self.appDB[appID]; ok {
-		db.use()
-		self.mu.RUnlock()
-		return db, nil
+	clock    Clock   // source of time, see [Config.Clock]
+	// Active [DB], sharded by ID of app, see [Mgr.shard]
+	shards []dbShard
+	idle   *idleMgr
+	sg     singleflight.Group
+	// Apps, which DB we failed to open recently
+	failures *failures
+
+	// Outstanding leases in debug mode, see [Config.LeaseDebug]
+	leases   map[*Lease]struct{}
+	leasesMu sync.Mutex
+
+	// Number of open pools of all [DB], active and idle. We use it for
+	// dividing the global connection budget, see [Config.MaxConns].
+	openPools int
+	budgetMu  sync.Mutex
+
+	// Apps from loaded snapshot, which pools weren't opened yet, see
+	// [Config.SnapshotFile].
+	history map[string]appSnapshot
+	// Guards history and request rates of [DB]
+	statsMu sync.Mutex
+	// Closing of snapStop stops saving of snapshots
+	snapStop     chan struct{}
+	snapStopOnce sync.Once
+	snapWG       sync.WaitGroup
+
+	// Registered []Observer, see [Mgr.AddObserver]. It's replaced on every
+	// change under observersMu.
+	observers   atomic.Value
+	observersMu sync.Mutex
+
+	// 1 after Close was called. It's changed under locks of all shards.
+	closed int32
+	// Number of calls of [Mgr.tryIdle], which are closing [DB] at this moment
+	closing int32
+	// Wakes up [Mgr.Close], when [Mgr.tryIdle] closed [DB]
+	closeWake chan struct{}
+}
+
+// DB returns [Lease] of [DB] pools for this appID. Also it returns error if any
+// or nil. When we don't need this DB anymore, the lease should be released by
+// [Lease.Release]. It's the same as [DBContext] with background context.
+func (self *Mgr) DB(appID string) (*Lease, error) {
+	return self.DBContext(context.Background(), appID)
+}
+
+// DBContext returns [DB] pools for this appID, like [DB], but it stops waiting
+// for them, when ctx is done, and returns ctx.Err() in this case. Opening of
+// pools isn't cancelled, because other callers may wait for the same appID.
+// If [Config.AcquireTimeout] is defined, it waits no longer than that.
+//
+// If we failed to open pools of this appID recently, it returns the same error
+// immediately, until backoff of this appID ends, see [Config.FailureBackoff].
+//
+// Every returned [Lease] counts as a request of the app in its last use time
+// and request rate, see [Config.SnapshotFile].
+func (self *Mgr) DBContext(ctx context.Context, appID string) (*Lease, error) {
+	if self.dbConfig.AcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.dbConfig.AcquireTimeout)
+		defer cancel()
 	}
-	self.mu.RUnlock()
 
-	_, err, _ := self.sg.Do(appID, func() (any, error) {
-		return self.maybeIdleDB(appID)
-	})
+	lease, err := self.acquire(ctx, appID)
+	self.notify(func(o Observer) { o.OnAcquire(appID, err) })
 	if err != nil {
 		return nil, err
 	}
+	lease.db.stats.touch(self.clock.Now())
+	return lease, nil
+}
+
+// acquire returns [Lease] of [DB] pools for this appID and error if any or
+// nil. It opens them or takes from [idleMgr], if they aren't active, and waits
+// for it until ctx is done.
+func (self *Mgr) acquire(ctx context.Context, appID string) (*Lease, error) {
+	s := self.shard(appID)
+	s.mu.RLock()
+	if self.isClosed() {
+		s.mu.RUnlock()
+		return nil, ErrClosed
+	} else if db, ok := s.appDB[appID]; ok {
+		// db becomes idle under write lock of the shard only, so it can't become
+		// idle here
+		atomic.AddInt32(&db.refs, 1)
+		s.mu.RUnlock()
+		return self.newLease(ctx, db), nil
+	}
+	s.mu.RUnlock()
+
+	if err := self.failures.err(appID); err != nil {
+		return nil, err
+	}
+
+	ch := self.sg.DoChan(appID, func() (any, error) {
+		db, err := self.maybeIdleDB(appID)
+		self.failures.report(appID, err)
+		return db, err
+	})
+	var db *DB
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		db = res.Val.(*DB)
+	case <-ctx.Done():
+		go self.idleUnused(ch)
+		return nil, ctx.Err()
+	}
+
+	s.mu.RLock()
+	if s.appDB[appID] == db && !self.isClosed() {
+		atomic.AddInt32(&db.refs, 1)
+		s.mu.RUnlock()
+		return self.newLease(ctx, db), nil
+	}
+	s.mu.RUnlock()
 
-	return self.DB(appID)
+	if self.isClosed() {
+		// db became active without leases and nobody can lease it after Close,
+		// so nobody would release it and Close would wait for it forever.
+		self.tryIdle(db)
+		return nil, ErrClosed
+	}
+	// db became idle already
+	return self.acquire(ctx, appID)
 }
 
-// maybeIdleDB returns [DB] from [idleMgr], and error if any or nil, for
-// specified appID. Returns nil instead of [DB] if this appID isn't registered
-// in [idleMgr].
+// idleUnused waits for result of opening [DB], which we stopped waiting for,
+// and moves it into [idleMgr], if nobody uses it. Without that such [DB] would
+// stay active forever, if nobody else asked for it.
+func (self *Mgr) idleUnused(ch <-chan singleflight.Result) {
+	res := <-ch
+	if res.Err != nil {
+		return
+	}
+
+	self.tryIdle(res.Val.(*DB))
+}
+
+// ClearFailure forgets recent failures of opening pools of appID, so the next
+// [DB] call tries to open them immediately. Returns true if appID had failures.
+func (self *Mgr) ClearFailure(appID string) bool {
+	return self.failures.clear(appID)
+}
+
+// maybeIdleDB returns active [DB] or [DB] from [idleMgr], and error if any or
+// nil, for specified appID. If this appID has no such [DB], it opens new [DB],
+// if the global connection budget allows it. Returned [DB] is active, but it
+// may have no leases.
 func (self *Mgr) maybeIdleDB(appID string) (*DB, error) {
-	db := self.idle.AppDB(appID)
-	if db == nil {
-		dbn, err := newDB(appID, self.dbConfig)
-		if err != nil {
-			return nil, err
-		}
-		db = dbn
+	// Under lock, so [Mgr.Close] can't miss db between idle and active ones
+	s := self.shard(appID)
+	s.mu.Lock()
+	if self.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	} else if db, ok := s.appDB[appID]; ok {
+		// opened by previous call, which finished after we missed db in acquire
+		s.mu.Unlock()
+		return db, nil
+	} else if db := self.idle.AppDB(appID); db != nil {
+		s.appDB[appID] = db
+		self.notify(func(o Observer) { o.OnRevive(appID) })
+		s.mu.Unlock()
+		return db, nil
+	}
+	s.mu.Unlock()
+
+	dbConfig := self.dbConfig.appConfig(appID)
+	pools := 1 + len(dbConfig.HostRO)
+	if err := self.reserve(pools); err != nil {
+		return nil, err
+	}
+
+	db, err := newDB(appID, dbConfig)
+	self.notify(func(o Observer) { o.OnOpen(appID, err) })
+	if err != nil {
+		self.unreserve(pools)
+		return nil, err
 	}
+	self.initStats(db)
 
-	self.mu.Lock()
-	self.appDB[appID] = db
-	self.mu.Unlock()
+	s.mu.Lock()
+	if self.isClosed() {
+		s.mu.Unlock()
+		self.idle.closeDB(db, "close")
+		return nil, ErrClosed
+	}
+	s.appDB[appID] = db
+	s.mu.Unlock()
+	self.rebalance()
 
 	return db, nil
 }
 
-// ReleaseDB returns db back into the manager. Should be called every time we
-// don't need db anymore, at the end of processing. If nobody else uses this db
-// at this moment, it'll be put into an idle list and later will be closed, if
-// nobody else will request it before.
-func (self *Mgr) ReleaseDB(db *DB) {
-	db.release()
-	self.mu.Lock()
-	if !db.inUse() {
-		self.idle.idleAppDB(db)
-		delete(self.appDB, db.AppID())
+// release releases one lease of db. If nobody else uses db at this moment,
+// it'll be put into an idle list, see [Mgr.deactivate].
+func (self *Mgr) release(db *DB) {
+	if atomic.AddInt32(&db.refs, -1) > 0 {
+		return
+	}
+
+	// somebody can lease db again before we lock, deactivate checks it
+	self.tryIdle(db)
+}
+
+// tryIdle moves active db into an idle list, if it has no leases, and closes
+// idle [DB] evicted by it.
+func (self *Mgr) tryIdle(db *DB) {
+	s := self.shard(db.AppID())
+	s.mu.Lock()
+	evicted := self.deactivate(s, db)
+	if len(evicted) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	op := "evict"
+	if self.isClosed() {
+		op = "close"
+	}
+	// under lock, so Close can't miss evicted between active and closed ones
+	atomic.AddInt32(&self.closing, 1)
+	s.mu.Unlock()
+
+	self.closeEvicted(evicted, op)
+	atomic.AddInt32(&self.closing, -1)
+	self.wakeClose()
+}
+
+// deactivate moves active db into an idle list, if it has no leases. If idle
+// list has more than [Config.MaxIdleDBs] entries, it returns the oldest ones,
+// which should be closed by [Mgr.closeEvicted]. After [Mgr.Close] it returns
+// db itself, because it should be closed immediately. Should be called under
+// write lock of shard s of db.
+func (self *Mgr) deactivate(s *dbShard, db *DB) []*DB {
+	if atomic.LoadInt32(&db.refs) > 0 || s.appDB[db.AppID()] != db {
+		return nil
+	}
+
+	delete(s.appDB, db.AppID())
+	if self.isClosed() {
+		return []*DB{db}
+	}
+	// under lock, so it's called before OnRevive of db
+	self.notify(func(o Observer) { o.OnIdle(db.AppID()) })
+	return self.idle.idleAppDB(db)
+}
+
+// closeEvicted closes every [DB] of evicted. op is reason of closing.
+func (self *Mgr) closeEvicted(evicted []*DB, op string) {
+	for _, db := range evicted {
+		self.idle.closeDB(db, op)
+	}
+}
+
+// Close closes the manager. It saves snapshot of hot apps into
+// [Config.SnapshotFile], if it's defined, stops expiration of idle [DB] and
+// closes all of them. After that it waits, until all leases of active [DB] are
+// released, and closes them too. If ctx is done before that, it closes active
+// [DB] immediately and returns error of ctx, which includes the first error of
+// closing, if any. Else it returns the first error of closing, if any, or nil.
+//
+// After Close, [Mgr.DB] returns [ErrClosed].
+func (self *Mgr) Close(ctx context.Context) error {
+	// Under locks of all shards, so nobody moves DB into idle list after
+	// closeAll.
+	for i := range self.shards {
+		self.shards[i].mu.Lock()
+	}
+	atomic.StoreInt32(&self.closed, 1)
+	for i := range self.shards {
+		self.shards[i].mu.Unlock()
+	}
+
+	// Save hot apps before we close them
+	self.stopSnapshots()
+	err := self.saveSnapshot()
+	if err != nil {
+		err = fmt.Errorf("save snapshot: %w", err)
+	}
+
+	self.idle.stop()
+	if closeErr := self.idle.closeAll(); err == nil {
+		err = closeErr
+	}
+
+	timer := self.clock.NewTimer(closeWaitInterval)
+	defer timer.Stop()
+	for !self.released() {
+		select {
+		case <-self.closeWake:
+		case <-timer.C():
+			timer.Reset(closeWaitInterval)
+		case <-ctx.Done():
+			if closeErr := self.closeActive(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("%w, close: %v", ctx.Err(), err)
+			}
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// wakeClose wakes up [Mgr.Close], so it checks, are all [DB] released. It
+// never blocks.
+func (self *Mgr) wakeClose() {
+	select {
+	case self.closeWake <- struct{}{}:
+	default:
+	}
+}
+
+// isClosed returns true after Close was called.
+func (self *Mgr) isClosed() bool {
+	return atomic.LoadInt32(&self.closed) != 0
+}
+
+// released returns true if all active [DB] were released and closed.
+func (self *Mgr) released() bool {
+	return self.numActive() == 0 && atomic.LoadInt32(&self.closing) == 0
+}
+
+// closeActive closes and removes all active [DB], even if somebody uses
+// them. Returns the first error of closing, if any, or nil.
+func (self *Mgr) closeActive() error {
+	var active []*DB
+	for i := range self.shards {
+		s := &self.shards[i]
+		s.mu.Lock()
+		for appID, db := range s.appDB {
+			active = append(active, db)
+			delete(s.appDB, appID)
+		}
+		s.mu.Unlock()
+	}
+
+	var firstErr error
+	for _, db := range active {
+		if err := self.idle.closeDB(db, "close"); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	self.mu.Unlock()
+	return firstErr
 }
@@ -1,59 +1,345 @@
 package db
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// newTestMgr creates [Mgr] like [NewMgr], but with fakeClock, if c has no
+// clock, so idle [DB] don't expire, until the test advances the clock. The
+// manager is stopped after the test.
+func newTestMgr(t testing.TB, c Config) *Mgr {
+	if c.Clock == nil {
+		c.Clock = newFakeClock()
+	}
+	m := NewMgr(c)
+	t.Cleanup(func() {
+		m.idle.stop()
+		m.stopSnapshots()
+	})
+	return m
+}
+
 func TestNewMgr(t *testing.T) {
 	a := assert.New(t)
 	r := require.New(t)
 
-	withTestIdleMgr(t)
 	m := NewMgr(Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+	defer m.Close(context.Background())
 	r.NotNil(m)
 	r.NotNil(m.idle)
-	a.IsType(m.idle, newIdleMgr())
+	a.IsType(m.idle, &idleMgr{})
+	a.Equal(m.clock, realClock{})
+	a.Equal(m.idle.clock, realClock{})
 }
 
 func TestDB(t *testing.T) {
 	a := assert.New(t)
 	r := require.New(t)
 
-	withTestIdleMgr(t)
-	m := NewMgr(Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
 	r.NotNil(m)
 
-	db, err := m.DB("demoa")
+	lease, err := m.DB("demoa")
 	r.NoError(err)
-	r.NotNil(db)
+	r.NotNil(lease)
+	db := lease.DB()
 	a.Equal(db.AppID(), "demoa")
-	a.Contains(m.appDB, "demoa")
-
-	db2 := m.appDB["demoa"]
-	r.NotNil(db2)
+	db2, ok := m.activeDB("demoa")
+	r.True(ok)
 	a.Same(db2, db)
+	a.Equal(db.refs, int32(1))
 
-	a.True(db.inUse())
-	a.Equal(db.useCnt, 1)
+	lease2, err := m.DB("demoa")
+	r.NoError(err)
+	a.Same(lease2.DB(), db)
+	a.Equal(db.refs, int32(2))
 }
 
-func TestReleaseDB(t *testing.T) {
+func TestDBContext(t *testing.T) {
 	a := assert.New(t)
 	r := require.New(t)
 
-	withTestIdleMgr(t)
-	m := NewMgr(Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+
+	// somebody else is opening demoa
+	started, opened := make(chan struct{}), make(chan struct{})
+	go m.sg.Do("demoa", func() (any, error) {
+		close(started)
+		<-opened
+		return m.maybeIdleDB("demoa")
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err := m.DBContext(ctx, "demoa")
+	r.ErrorIs(err, context.DeadlineExceeded)
+
+	m.dbConfig.AcquireTimeout = time.Millisecond
+	_, err = m.DB("demoa")
+	r.ErrorIs(err, context.DeadlineExceeded)
+
+	// nobody waits for opened demoa, so it becomes idle
+	close(opened)
+	a.Eventually(func() bool { return m.idle.onIdle("demoa") },
+		time.Second, time.Millisecond)
+
+	m.dbConfig.AcquireTimeout = time.Second
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Equal(lease.DB().AppID(), "demoa")
+	a.False(m.idle.onIdle("demoa"))
+}
+
+func TestLeaseRelease(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
 	r.NotNil(m)
 
-	db, err := m.DB("demoa")
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	lease2, err := m.DB("demoa")
 	r.NoError(err)
-	r.NotNil(db)
+	db := lease.DB()
+
+	lease.Release()
+	a.Equal(db.refs, int32(1))
+	_, ok := m.activeDB("demoa")
+	a.True(ok)
+
+	lease.Release()
+	a.Equal(db.refs, int32(1), "lease released twice")
+	_, ok = m.activeDB("demoa")
+	a.True(ok)
 
-	m.ReleaseDB(db)
-	a.False(db.inUse())
-	a.NotContains(m.appDB, "demoa")
+	lease2.Release()
+	a.Zero(db.refs)
+	_, ok = m.activeDB("demoa")
+	a.False(ok)
 	a.True(m.idle.onIdle(db.AppID()))
 }
+
+func TestDBAppConfig(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Apps:   map[string]AppConfig{"demob": {HostRO: []string{"tcp(127.0.0.1)"}}},
+	})
+	r.NotNil(m)
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Nil(lease.DB().RO())
+
+	lease, err = m.DB("demob")
+	r.NoError(err)
+	a.NotNil(lease.DB().RO())
+}
+
+func TestLeaseReleaseMaxIdle(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:     "mysql",
+		HostRW:     "tcp(127.0.0.1)",
+		MaxIdleDBs: 1,
+	})
+
+	leaseA, err := m.DB("demoa")
+	r.NoError(err)
+	leaseB, err := m.DB("demob")
+	r.NoError(err)
+	dba := leaseA.DB()
+
+	leaseA.Release()
+	a.True(m.idle.onIdle("demoa"))
+	leaseB.Release()
+	a.True(m.idle.onIdle("demob"))
+	a.False(m.idle.onIdle("demoa"))
+	a.Nil(dba.RW(), "evicted DB isn't closed")
+}
+
+func TestMgrClose(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+
+	leaseA, err := m.DB("demoa")
+	r.NoError(err)
+	leaseB, err := m.DB("demob")
+	r.NoError(err)
+	dba, dbb := leaseA.DB(), leaseB.DB()
+	leaseB.Release()
+	r.True(m.idle.onIdle("demob"))
+	o := &testObserver{}
+	m.AddObserver(o)
+
+	closed := make(chan error)
+	go func() { closed <- m.Close(context.Background()) }()
+
+	select {
+	case <-closed:
+		a.FailNow("Close didn't wait for active DB")
+	case <-time.After(5 * closeWaitInterval):
+	}
+	a.False(m.idle.onIdle("demob"))
+	// events are synchronized with closing of DB
+	a.Equal(o.reset(), []string{"close demob <nil>"})
+	a.Nil(dbb.RW(), "idle DB isn't closed")
+	a.NotNil(dba.RW(), "active DB closed")
+
+	_, err = m.DB("democ")
+	a.ErrorIs(err, ErrClosed)
+
+	leaseA.Release()
+	select {
+	case err := <-closed:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.FailNow("Close didn't return after release")
+	}
+	a.Nil(dba.RW(), "released DB isn't closed")
+	a.False(m.idle.onIdle("demoa"))
+}
+
+func TestMgrCloseDeadline(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:   "mysql",
+		HostRW:   "tcp(127.0.0.1)",
+		MaxConns: 10,
+	})
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	db := lease.DB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeWaitInterval)
+	defer cancel()
+	a.ErrorIs(m.Close(ctx), context.DeadlineExceeded)
+	a.Nil(db.RW(), "active DB isn't closed")
+	a.Zero(m.numActive())
+	a.Zero(m.openPools)
+
+	lease.Release()
+	a.Zero(m.openPools, "closed DB released twice")
+
+	// errors of closing aren't lost
+	m = newTestMgr(t, Config{
+		Driver:       "mysql",
+		HostRW:       "tcp(127.0.0.1)",
+		SnapshotFile: filepath.Join(t.TempDir(), "missing", "snapshot"),
+	})
+	lease, err = m.DB("demoa")
+	r.NoError(err)
+	defer lease.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), closeWaitInterval)
+	defer cancel()
+	err = m.Close(ctx)
+	a.ErrorIs(err, context.DeadlineExceeded)
+	a.ErrorContains(err, "save snapshot")
+}
+
+func TestMgrCloseAcquire(t *testing.T) {
+	a := assert.New(t)
+
+	// Close shouldn't miss DB, which became active, while it was closing
+	for i := 0; i < 50; i++ {
+		m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for j := 0; ; j++ {
+					lease, err := m.DB(fmt.Sprintf("demo%d", (g+j)%8))
+					if err != nil {
+						return
+					}
+					lease.Release()
+				}
+			}(g)
+		}
+
+		time.Sleep(time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		a.NoError(m.Close(ctx))
+		cancel()
+		wg.Wait()
+		a.Zero(m.numActive())
+	}
+}
+
+func TestMgrConcurrentOpen(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:   "mysql",
+		HostRW:   "tcp(127.0.0.1)",
+		MaxConns: 10,
+	})
+
+	// the previous call opened DB, which is active
+	db, err := m.maybeIdleDB("demoa")
+	r.NoError(err)
+	db2, err := m.maybeIdleDB("demoa")
+	r.NoError(err)
+	a.Same(db2, db)
+	m.tryIdle(db)
+
+	// concurrent first acquisitions open DB once
+	for i := 0; i < 50; i++ {
+		m := newTestMgr(t, Config{
+			Driver:   "mysql",
+			HostRW:   "tcp(127.0.0.1)",
+			MaxConns: 10,
+		})
+		o := &testObserver{}
+		m.AddObserver(o)
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 64; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				lease, err := m.DB("demoa")
+				if err == nil {
+					lease.Release()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		opened := 0
+		for _, event := range o.reset() {
+			if event == "open demoa <nil>" {
+				opened++
+			}
+		}
+		r.Equal(opened, 1)
+		r.True(m.idle.onIdle("demoa"))
+		r.Equal(m.openPools, m.idle.AppDB("demoa").pools())
+	}
+}
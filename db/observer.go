@@ -0,0 +1,62 @@
+package db
+
+// Observer observes lifecycle of [DB] of apps in [Mgr], see [Mgr.AddObserver].
+// We can use it for metrics, logging, invalidation of caches or warm-up logic.
+//
+// Methods are called synchronously, some of them under internal locks of
+// [Mgr], so they should be fast and shouldn't call methods of [Mgr]. They can be
+// called from different goroutines. Embed [NopObserver] for implementing only
+// some of them.
+type Observer interface {
+	// OnOpen is called after we tried to open pools of appID. err is error of
+	// opening or nil.
+	OnOpen(appID string, err error)
+	// OnAcquire is called after [Mgr.DBContext] returned [Lease] of appID. err
+	// is its error or nil.
+	OnAcquire(appID string, err error)
+	// OnIdle is called after DB of appID became idle, because nobody uses it.
+	OnIdle(appID string)
+	// OnRevive is called after idle DB of appID became active again.
+	OnRevive(appID string)
+	// OnClose is called after pools of appID were closed. reason is "expire",
+	// if TTL of idle DB expired, "evict", if it was evicted for another app, or
+	// "close", if [Mgr] was closed. err is error of closing or nil.
+	OnClose(appID, reason string, err error)
+}
+
+// NopObserver is [Observer], which does nothing. Embed it into your Observer,
+// if you need only some of its methods.
+type NopObserver struct{}
+
+func (NopObserver) OnOpen(appID string, err error)          {}
+func (NopObserver) OnAcquire(appID string, err error)       {}
+func (NopObserver) OnIdle(appID string)                     {}
+func (NopObserver) OnRevive(appID string)                   {}
+func (NopObserver) OnClose(appID, reason string, err error) {}
+
+// AddObserver registers o, so it observes lifecycle of every [DB] after that.
+// It's safe to call it, while [Mgr] is used.
+func (self *Mgr) AddObserver(o Observer) {
+	self.observersMu.Lock()
+	defer self.observersMu.Unlock()
+
+	// copy on write, so notify doesn't lock
+	old := self.observerList()
+	observers := make([]Observer, len(old), len(old)+1)
+	copy(observers, old)
+	self.observers.Store(append(observers, o))
+}
+
+// observerList returns registered observers. Returned slice shouldn't be
+// modified.
+func (self *Mgr) observerList() []Observer {
+	observers, _ := self.observers.Load().([]Observer)
+	return observers
+}
+
+// notify calls fn for every registered observer.
+func (self *Mgr) notify(fn func(o Observer)) {
+	for _, o := range self.observerList() {
+		fn(o)
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testObserver records lifecycle events as strings
+type testObserver struct {
+	events []string
+	mu     sync.Mutex
+}
+
+func (self *testObserver) add(format string, args ...any) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.events = append(self.events, fmt.Sprintf(format, args...))
+}
+
+// reset returns recorded events and forgets them
+func (self *testObserver) reset() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	events := self.events
+	self.events = nil
+	return events
+}
+
+func (self *testObserver) OnOpen(appID string, err error) {
+	self.add("open %v %v", appID, err)
+}
+
+func (self *testObserver) OnAcquire(appID string, err error) {
+	self.add("acquire %v %v", appID, err)
+}
+
+func (self *testObserver) OnIdle(appID string) {
+	self.add("idle %v", appID)
+}
+
+func (self *testObserver) OnRevive(appID string) {
+	self.add("revive %v", appID)
+}
+
+func (self *testObserver) OnClose(appID, reason string, err error) {
+	self.add("%v %v %v", reason, appID, err)
+}
+
+func TestObserver(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:     "mysql",
+		HostRW:     "tcp(127.0.0.1)",
+		MaxIdleDBs: 1,
+		// expiration loop doesn't run, while we advance clock by idle TTL
+		IdleInterval: time.Hour,
+	})
+	var o testObserver
+	m.AddObserver(&o)
+	m.AddObserver(NopObserver{})
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	lease.Release()
+	a.Equal(o.reset(), []string{
+		"open demoa <nil>",
+		"acquire demoa <nil>",
+		"idle demoa",
+	})
+
+	lease, err = m.DB("demoa")
+	r.NoError(err)
+	a.Equal(o.reset(), []string{"revive demoa", "acquire demoa <nil>"})
+	lease.Release()
+
+	lease, err = m.DB("demob")
+	r.NoError(err)
+	lease.Release()
+	a.Equal(o.reset(), []string{
+		"idle demoa",
+		"open demob <nil>",
+		"acquire demob <nil>",
+		"idle demob",
+		"evict demoa <nil>",
+	})
+
+	m.clock.(*fakeClock).Advance(defMaxTTL)
+	m.idle.expire()
+	a.Equal(o.reset(), []string{"expire demob <nil>"})
+
+	lease, err = m.DB("democ")
+	r.NoError(err)
+	closed := make(chan error)
+	go func() { closed <- m.Close(context.Background()) }()
+	a.Eventually(m.isClosed, time.Second, time.Millisecond)
+	a.Equal(o.reset(), []string{"open democ <nil>", "acquire democ <nil>"})
+	lease.Release()
+	r.NoError(<-closed)
+	a.Equal(o.reset(), []string{"close democ <nil>"})
+
+	_, err = m.DB("demod")
+	a.ErrorIs(err, ErrClosed)
+	a.Equal(o.reset(), []string{"acquire demod " + ErrClosed.Error()})
+}
+
+func TestObserverOpenError(t *testing.T) {
+	a := assert.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql", HostRW: "tcp(127.0.0.1)"})
+	var o testObserver
+	m.AddObserver(&o)
+
+	m.dbConfig.ROBalance = "random"
+	_, err := m.DB("demoa")
+	a.Error(err)
+	a.Equal(o.reset(), []string{
+		"open demoa " + err.Error(),
+		"acquire demoa " + err.Error(),
+	})
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of [ConnError]
+var (
+	// ErrUnknownDB means database of the app doesn't exist on the server
+	ErrUnknownDB = errors.New("db: unknown database")
+	// ErrAuth means the server rejected our username or password
+	ErrAuth = errors.New("db: authentication failed")
+	// ErrUnreachable means we can't reach the server in time
+	ErrUnreachable = errors.New("db: server unreachable")
+	// ErrTooManyConns means the server has no free connections for us
+	ErrTooManyConns = errors.New("db: too many connections")
+)
+
+// ConnError is returned by [Mgr.DB], when we can't connect to the server of the
+// app, see [Config.PingTimeout]. It works with [errors.Is] for its Kind and
+// for wrapped Err.
+type ConnError struct {
+	// One of ErrUnknownDB, ErrAuth, ErrUnreachable, ErrTooManyConns or nil, if
+	// we don't know what happened.
+	Kind error
+	Host string // host we tried to connect to
+	Err  error  // error returned by the driver
+}
+
+func (self *ConnError) Error() string {
+	if self.Kind == nil {
+		return fmt.Sprintf("db: ping %s: %v", self.Host, self.Err)
+	}
+	return fmt.Sprintf("%v: %s: %v", self.Kind, self.Host, self.Err)
+}
+
+func (self *ConnError) Unwrap() error {
+	return self.Err
+}
+
+// Is returns true if target is Kind of this error. It makes [errors.Is] works
+// with kinds of errors.
+func (self *ConnError) Is(target error) bool {
+	return self.Kind != nil && target == self.Kind
+}
+
+// pingDB checks connection to host, waiting no longer than timeout. Returns
+// [ConnError] if it failed or nil.
+func pingDB(db *sqlx.DB, host string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return &ConnError{Kind: connErrorKind(err), Host: host, Err: err}
+	}
+	return nil
+}
+
+// connErrorKind returns kind of [ConnError] for err returned by the driver, or
+// nil if it's unknown error.
+func connErrorKind(err error) error {
+	var myErr *mysql.MySQLError
+	var pgErr *pgconn.PgError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &myErr):
+		switch myErr.Number {
+		case 1049: // ER_BAD_DB_ERROR
+			return ErrUnknownDB
+		case 1044, 1045: // ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR
+			return ErrAuth
+		case 1040, 1203: // ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONNECTIONS
+			return ErrTooManyConns
+		}
+	case errors.As(err, &pgErr):
+		switch pgErr.Code {
+		case "3D000": // invalid_catalog_name
+			return ErrUnknownDB
+		case "28000", "28P01": // invalid_authorization_specification
+			return ErrAuth
+		case "53300": // too_many_connections
+			return ErrTooManyConns
+		}
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+		return ErrUnreachable
+	}
+	return nil
+}
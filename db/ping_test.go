@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnErrorKind(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{&mysql.MySQLError{Number: 1049}, ErrUnknownDB},
+		{&mysql.MySQLError{Number: 1045}, ErrAuth},
+		{&mysql.MySQLError{Number: 1040}, ErrTooManyConns},
+		{&mysql.MySQLError{Number: 1064}, nil},
+		{&pgconn.PgError{Code: "3D000"}, ErrUnknownDB},
+		{&pgconn.PgError{Code: "28P01"}, ErrAuth},
+		{fmt.Errorf("connect: %w", &pgconn.PgError{Code: "53300"}),
+			ErrTooManyConns},
+		{&pgconn.PgError{Code: "42601"}, nil},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			ErrUnreachable},
+		{context.DeadlineExceeded, ErrUnreachable},
+		{errors.New("something"), nil},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(connErrorKind(tt.err), tt.kind, tt.err.Error())
+	}
+}
+
+func TestConnError(t *testing.T) {
+	assert := assert.New(t)
+
+	myErr := &mysql.MySQLError{Number: 1049, Message: "Unknown database"}
+	err := error(&ConnError{Kind: ErrUnknownDB, Host: "tcp(db1)", Err: myErr})
+	assert.ErrorIs(err, ErrUnknownDB)
+	assert.ErrorIs(err, myErr)
+	assert.NotErrorIs(err, ErrAuth)
+	assert.Equal(err.Error(),
+		"db: unknown database: tcp(db1): Error 1049: Unknown database")
+
+	err = &ConnError{Host: "tcp(db1)", Err: errors.New("something")}
+	assert.NotErrorIs(err, ErrUnreachable)
+	assert.Equal(err.Error(), "db: ping tcp(db1): something")
+}
+
+func TestNewDBPing(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	host := fmt.Sprintf("tcp(%s)", l.Addr())
+	require.NoError(l.Close())
+
+	c := &Config{
+		Driver:      "mysql",
+		HostRW:      host,
+		HostRO:      []string{host},
+		PingTimeout: time.Second,
+	}
+	_, err = newDB("demoa", c)
+	assert.ErrorIs(err, ErrUnreachable)
+	var connErr *ConnError
+	require.ErrorAs(err, &connErr)
+	assert.Equal(connErr.Host, host)
+}
@@ -0,0 +1,299 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// Ways of selecting replica by [DB.RO].
+const (
+	// Select replicas one by one.
+	BalanceRoundRobin = "round-robin"
+	// Select replica with the least number of connections in use.
+	BalanceLeastInFlight = "least-in-flight"
+)
+
+const (
+	// Interval between health checks of a replica.
+	defHealthInterval = 10 * time.Second
+
+	// Interval between health checks of an unhealthy replica, which circuit is
+	// open. We re-probe it and close the circuit as soon as it's alive again.
+	defProbeInterval = 3 * time.Second
+
+	// Max time of one health check of a replica.
+	defHealthTimeout = 2 * time.Second
+)
+
+// validBalance returns true if balance is known way of selecting replica. Empty
+// string is valid too and means [BalanceRoundRobin].
+func validBalance(balance string) bool {
+	switch balance {
+	case "", BalanceRoundRobin, BalanceLeastInFlight:
+		return true
+	}
+	return false
+}
+
+// lagFunc defines function, which returns replication lag of replica db and
+// error if any or nil.
+type lagFunc func(ctx context.Context, db *sqlx.DB) (time.Duration, error)
+
+// lagFuncs contains [lagFunc] for every known driver. Key is name of database
+// driver.
+var lagFuncs = map[string]lagFunc{
+	"mysql": mysqlLag,
+	"pgx":   pgxLag,
+}
+
+// mysqlLag returns replication lag of MySQL replica db, using "SHOW REPLICA
+// STATUS". If db isn't a replica, the lag is 0.
+func mysqlLag(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for i, col := range cols {
+		if col != "Seconds_Behind_Source" && col != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("replication isn't running")
+		}
+		secs, err := strconv.ParseInt(values[i].String, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse %v: %w", col, err)
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+
+	return 0, errors.New("replica status without lag")
+}
+
+// pgxLag returns replication lag of PostgreSQL replica db, using
+// pg_last_xact_replay_timestamp(). If db isn't a replica, the lag is 0.
+func pgxLag(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+	var secs float64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(
+		EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)`,
+	).Scan(&secs)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// newReplica creates and returns replica for pool db, connected to host. If
+// maxLag > 0, health check of the replica queries its replication lag by
+// lagFn and replica with lag more than maxLag is unhealthy. Intervals between
+// health checks are measured by clock.
+func newReplica(db *sqlx.DB, host string, lagFn lagFunc,
+	maxLag time.Duration, clock Clock,
+) *replica {
+	r := &replica{db: db, host: host, healthy: 1, clock: clock}
+	if maxLag > 0 {
+		r.lagFn = lagFn
+		r.maxLag = maxLag
+	}
+	return r
+}
+
+// replica defines pool of read-only connections to one replica and its health
+// state. It's safe to call its methods from different goroutines.
+//
+// The health state works like a circuit breaker. While the replica is healthy,
+// its circuit is closed and we read from it. Any failed health check or
+// connection error opens the circuit and we stop reading from it. Every
+// [defProbeInterval] we re-probe the replica and close the circuit, if the
+// replica is alive again.
+type replica struct {
+	// Pool of connections to the replica
+	db *sqlx.DB
+	// Host of the replica, for logging only
+	host string
+	// 1 if the circuit is closed and the replica is healthy, 0 if the circuit is
+	// open
+	healthy int32
+	// 1 while health check is running
+	checking int32
+	// Time of last health check in unix nanoseconds
+	checkedAt int64
+	// Source of time of health checks
+	clock Clock
+
+	// Returns replication lag of the replica. nil if we don't check the lag.
+	lagFn lagFunc
+	// Max replication lag of healthy replica
+	maxLag time.Duration
+	// Replication lag of the replica from last health check
+	lag int64
+}
+
+// isHealthy returns true if last health check of the replica succeeded.
+func (self *replica) isHealthy() bool {
+	return atomic.LoadInt32(&self.healthy) == 1
+}
+
+// maybeCheck starts health check of the replica in background, if last health
+// check was more than [defHealthInterval] ago, or [defProbeInterval] for
+// unhealthy replica, and no other check is running.
+func (self *replica) maybeCheck() {
+	interval := defHealthInterval
+	if !self.isHealthy() {
+		interval = defProbeInterval
+	}
+
+	checkedAt := atomic.LoadInt64(&self.checkedAt)
+	if self.clock.Now().Sub(time.Unix(0, checkedAt)) < interval {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&self.checking, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&self.checking, 0)
+		self.check()
+	}()
+}
+
+// check pings the replica, checks its replication lag and updates its health
+// state.
+func (self *replica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), defHealthTimeout)
+	defer cancel()
+
+	err := self.db.PingContext(ctx)
+	if err == nil && self.lagFn != nil {
+		err = self.checkLag(ctx)
+	}
+	atomic.StoreInt64(&self.checkedAt, self.clock.Now().UnixNano())
+	self.setHealth(err)
+}
+
+// fail opens the circuit of the replica because of connection error err. Next
+// re-probe will be after [defProbeInterval].
+func (self *replica) fail(err error) {
+	atomic.StoreInt64(&self.checkedAt, self.clock.Now().UnixNano())
+	self.setHealth(err)
+}
+
+// setHealth opens the circuit of the replica if err isn't nil, or closes it
+// otherwise. Logs every change of the state.
+func (self *replica) setHealth(err error) {
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&self.healthy, 1, 0) {
+			log.Printf("replica %v: circuit open: %v", self.host, err)
+		}
+	} else if atomic.CompareAndSwapInt32(&self.healthy, 0, 1) {
+		log.Printf("replica %v: circuit closed", self.host)
+	}
+}
+
+// checkLag queries replication lag of the replica and saves it. Returns error if
+// the lag is more than maxLag or we can't get it.
+func (self *replica) checkLag(ctx context.Context) error {
+	lag, err := self.lagFn(ctx, self.db)
+	if err != nil {
+		return fmt.Errorf("replication lag: %w", err)
+	}
+	atomic.StoreInt64(&self.lag, int64(lag))
+
+	if lag > self.maxLag {
+		return fmt.Errorf("replication lag %v more than %v", lag, self.maxLag)
+	}
+	return nil
+}
+
+// replicationLag returns replication lag of the replica from last health
+// check. It's always 0 if we don't check the lag.
+func (self *replica) replicationLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.lag))
+}
+
+// inFlight returns number of connections in use at this moment.
+func (self *replica) inFlight() int {
+	return self.db.Stats().InUse
+}
+
+// pickReplica selects replica from replicas according to balance. It skips
+// unhealthy replicas and returns nil if all of them are unhealthy. next is
+// counter of [BalanceRoundRobin].
+func pickReplica(replicas []*replica, balance string, next *uint32) *replica {
+	for _, r := range replicas {
+		r.maybeCheck()
+	}
+
+	if balance == BalanceLeastInFlight {
+		return leastInFlight(replicas)
+	}
+	return roundRobin(replicas, next)
+}
+
+// roundRobin returns next healthy replica after the one returned last time or
+// nil if all replicas are unhealthy.
+func roundRobin(replicas []*replica, next *uint32) *replica {
+	n := uint32(len(replicas))
+	start := atomic.AddUint32(next, 1)
+	for i := uint32(0); i < n; i++ {
+		if r := replicas[(start+i)%n]; r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// leastInFlight returns healthy replica with the least number of connections in
+// use or nil if all replicas are unhealthy.
+func leastInFlight(replicas []*replica) *replica {
+	var best *replica
+	bestInFlight := 0
+	for _, r := range replicas {
+		if !r.isHealthy() {
+			continue
+		}
+		if n := r.inFlight(); best == nil || n < bestInFlight {
+			best, bestInFlight = r, n
+		}
+	}
+	return best
+}
+
+// isConnError returns true if err means we can't connect to the server or lost
+// connection to it.
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.As(err, &netErr)
+}
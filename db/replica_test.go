@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReplicas returns n replicas with common fakeClock, which don't need
+// health check at this moment.
+func testReplicas(t *testing.T, n int) []*replica {
+	clock := newFakeClock()
+	replicas := make([]*replica, n)
+	for i := range replicas {
+		db, err := sqlx.Open("mysql", "tcp(127.0.0.1)/demoa")
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		replicas[i] = newReplica(db, "tcp(127.0.0.1)", nil, 0, clock)
+		replicas[i].checkedAt = clock.Now().UnixNano()
+	}
+	return replicas
+}
+
+func TestValidBalance(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(validBalance(""))
+	assert.True(validBalance(BalanceRoundRobin))
+	assert.True(validBalance(BalanceLeastInFlight))
+	assert.False(validBalance("random"))
+}
+
+func TestRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+
+	replicas := testReplicas(t, 3)
+	var next uint32
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[1])
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[2])
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[0])
+
+	replicas[1].healthy = 0
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[2])
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[2])
+	assert.Same(pickReplica(replicas, BalanceRoundRobin, &next), replicas[0])
+
+	for _, r := range replicas {
+		r.healthy = 0
+	}
+	assert.Nil(pickReplica(replicas, BalanceRoundRobin, &next))
+}
+
+func TestLeastInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	replicas := testReplicas(t, 2)
+	assert.Same(pickReplica(replicas, BalanceLeastInFlight, nil), replicas[0])
+
+	replicas[0].healthy = 0
+	assert.Same(pickReplica(replicas, BalanceLeastInFlight, nil), replicas[1])
+
+	replicas[1].healthy = 0
+	assert.Nil(pickReplica(replicas, BalanceLeastInFlight, nil))
+}
+
+func TestReplicaCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testReplicas(t, 1)[0]
+	r.checkedAt = 0
+	assert.True(r.isHealthy())
+
+	r.check()
+	assert.False(r.isHealthy(), "replica without server is healthy")
+	assert.NotZero(r.checkedAt)
+}
+
+func TestReplicaFail(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testReplicas(t, 1)[0]
+	r.checkedAt = 0
+	r.fail(driver.ErrBadConn)
+	assert.False(r.isHealthy())
+	assert.Equal(r.checkedAt, r.clock.Now().UnixNano())
+
+	r.setHealth(nil)
+	assert.True(r.isHealthy())
+}
+
+func TestReplicaMaybeCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testReplicas(t, 1)[0]
+	clock := r.clock.(*fakeClock)
+	// checked returns true, if maybeCheck checked the replica
+	checked := func() bool {
+		checkedAt := atomic.LoadInt64(&r.checkedAt)
+		r.maybeCheck()
+		assert.Eventually(func() bool {
+			return atomic.LoadInt32(&r.checking) == 0
+		}, time.Second, time.Millisecond)
+		return atomic.LoadInt64(&r.checkedAt) != checkedAt
+	}
+
+	clock.Advance(defHealthInterval - time.Nanosecond)
+	assert.False(checked(), "checked before health interval")
+	clock.Advance(time.Nanosecond)
+	assert.True(checked())
+	assert.False(r.isHealthy(), "replica without server is healthy")
+
+	// unhealthy replica is re-probed more often
+	clock.Advance(defProbeInterval - time.Nanosecond)
+	assert.False(checked(), "checked before probe interval")
+	clock.Advance(time.Nanosecond)
+	assert.True(checked())
+}
+
+func TestIsConnError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isConnError(driver.ErrBadConn))
+	assert.True(isConnError(fmt.Errorf("query: %w", mysql.ErrInvalidConn)))
+	assert.True(isConnError(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+	assert.False(isConnError(sql.ErrNoRows))
+	assert.False(isConnError(errors.New("syntax error")))
+}
+
+func TestReplicaLag(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testReplicas(t, 1)[0]
+	lag := time.Second
+	r.lagFn = func(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+		return lag, nil
+	}
+	r.maxLag = 5 * time.Second
+
+	ctx := context.Background()
+	assert.NoError(r.checkLag(ctx))
+	assert.Equal(r.replicationLag(), time.Second)
+
+	lag = 10 * time.Second
+	assert.Error(r.checkLag(ctx))
+	assert.Equal(r.replicationLag(), 10*time.Second)
+
+	r.lagFn = func(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+		return 0, errors.New("access denied")
+	}
+	assert.Error(r.checkLag(ctx))
+}
+
+func TestNewReplica(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newReplica(nil, "tcp(127.0.0.1)", mysqlLag, 0, realClock{})
+	assert.Nil(r.lagFn, "lag checked without maxLag")
+	assert.True(r.isHealthy())
+	assert.Equal(r.clock, realClock{})
+
+	r = newReplica(nil, "tcp(127.0.0.1)", mysqlLag, time.Second, realClock{})
+	assert.NotNil(r.lagFn)
+	assert.Equal(r.maxLag, time.Second)
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Default number of shards of active [DB], see [Config.Shards].
+const defShards = 32
+
+// dbShard is a shard of active [DB]. Every shard has its own lock, so requests
+// of apps from different shards don't wait for each other.
+type dbShard struct {
+	// Creates link between ID of app and pool of DB connections to its database
+	appDB map[string]*DB
+	mu    sync.RWMutex
+}
+
+// newShards creates and returns n shards of active [DB]. Zero n means
+// [defShards].
+func newShards(n int) []dbShard {
+	if n <= 0 {
+		n = defShards
+	}
+	shards := make([]dbShard, n)
+	for i := range shards {
+		shards[i].appDB = make(map[string]*DB)
+	}
+	return shards
+}
+
+// shard returns shard of active [DB], which keeps DB of appID.
+func (self *Mgr) shard(appID string) *dbShard {
+	if len(self.shards) == 1 {
+		return &self.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(appID))
+	return &self.shards[h.Sum32()%uint32(len(self.shards))]
+}
+
+// eachActive calls fn for every active [DB]. fn is called under read lock of
+// its shard.
+func (self *Mgr) eachActive(fn func(db *DB)) {
+	for i := range self.shards {
+		s := &self.shards[i]
+		s.mu.RLock()
+		for _, db := range s.appDB {
+			fn(db)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// activeDB returns active [DB] of appID and true, or nil and false, if appID
+// hasn't active DB.
+func (self *Mgr) activeDB(appID string) (*DB, bool) {
+	s := self.shard(appID)
+	s.mu.RLock()
+	db, ok := s.appDB[appID]
+	s.mu.RUnlock()
+	return db, ok
+}
+
+// numActive returns number of active [DB].
+func (self *Mgr) numActive() int {
+	n := 0
+	for i := range self.shards {
+		s := &self.shards[i]
+		s.mu.RLock()
+		n += len(s.appDB)
+		s.mu.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewShards(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(newShards(0), defShards)
+	shards := newShards(4)
+	assert.Len(shards, 4)
+	for i := range shards {
+		assert.NotNil(shards[i].appDB)
+	}
+}
+
+func TestShard(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Shards: 8,
+	})
+	assert.Same(m.shard("demoa"), m.shard("demoa"))
+
+	used := make(map[*dbShard]bool)
+	for i := 0; i < 100; i++ {
+		used[m.shard(fmt.Sprintf("demo%d", i))] = true
+	}
+	assert.Len(used, 8)
+
+	m = newTestMgr(t, Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Shards: 1,
+	})
+	assert.Same(m.shard("demoa"), &m.shards[0])
+}
+
+func TestShardsActive(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Shards: 4,
+	})
+
+	var leases []*Lease
+	for i := 0; i < 10; i++ {
+		lease, err := m.DB(fmt.Sprintf("demo%d", i))
+		r.NoError(err)
+		leases = append(leases, lease)
+	}
+	a.Equal(m.numActive(), 10)
+
+	n := 0
+	m.eachActive(func(db *DB) { n++ })
+	a.Equal(n, 10)
+
+	for _, lease := range leases {
+		lease.Release()
+	}
+	a.Zero(m.numActive())
+}
+
+// BenchmarkLease leases and releases DB of tenants apps in parallel. Every app
+// has one more long lease, so its DB stays active and we measure contention of
+// active DB only. Compare 1 shard (single lock) with default number of shards
+// and with global lock, which models previous design of [Mgr].
+func BenchmarkLease(b *testing.B) {
+	for _, tenants := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("global/tenants=%d", tenants), func(b *testing.B) {
+			benchmarkGlobalLease(b, tenants)
+		})
+	}
+	for _, shards := range []int{1, defShards} {
+		for _, tenants := range []int{1, 100, 1000} {
+			name := fmt.Sprintf("shards=%d/tenants=%d", shards, tenants)
+			b.Run(name, func(b *testing.B) {
+				benchmarkLease(b, shards, tenants)
+			})
+		}
+	}
+}
+
+// globalMgr models previous design of [Mgr]: active [DB] are kept under one
+// global lock, they are leased under read lock, but every release takes write
+// lock to check, if [DB] became idle.
+type globalMgr struct {
+	mu    sync.RWMutex
+	appDB map[string]*DB
+}
+
+func (self *globalMgr) acquire(appID string) *Lease {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	db := self.appDB[appID]
+	atomic.AddInt32(&db.refs, 1)
+	return &Lease{db: db}
+}
+
+func (self *globalMgr) release(lease *Lease) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	db := lease.db
+	if atomic.AddInt32(&db.refs, -1) == 0 && self.appDB[db.AppID()] == db {
+		delete(self.appDB, db.AppID())
+	}
+}
+
+func benchmarkGlobalLease(b *testing.B, tenants int) {
+	m := &globalMgr{appDB: make(map[string]*DB, tenants)}
+	apps := make([]string, tenants)
+	for i := range apps {
+		apps[i] = fmt.Sprintf("demo%d", i)
+		// one more long lease, like in benchmarkLease
+		m.appDB[apps[i]] = &DB{appID: apps[i], refs: 1}
+	}
+
+	var next uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&next, 7919))
+		for pb.Next() {
+			i++
+			m.release(m.acquire(apps[i%len(apps)]))
+		}
+	})
+}
+
+func benchmarkLease(b *testing.B, shards, tenants int) {
+	m := newTestMgr(b, Config{
+		Driver: "mysql",
+		HostRW: "tcp(127.0.0.1)",
+		Shards: shards,
+	})
+
+	apps := make([]string, tenants)
+	for i := range apps {
+		apps[i] = fmt.Sprintf("demo%d", i)
+		lease, err := m.DB(apps[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer lease.Release()
+	}
+
+	var next uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&next, 7919))
+		for pb.Next() {
+			i++
+			lease, err := m.DB(apps[i%len(apps)])
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			lease.Release()
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default interval of writing snapshot, see [Config.SnapshotInterval].
+	defSnapshotInterval = time.Minute
+
+	// Apps from loaded snapshot, which weren't used longer than this, are
+	// forgotten.
+	snapshotMaxAge = 24 * time.Hour
+
+	// Time window of request rate of an app. The rate is exponential moving
+	// average of requests per second, where weight of requests decreases e
+	// times every window.
+	rateWindow = 5 * time.Minute
+)
+
+// snapshot defines JSON file, where we save hot apps, see
+// [Config.SnapshotFile].
+type snapshot struct {
+	Saved time.Time     `json:"saved"`
+	Apps  []appSnapshot `json:"apps"`
+}
+
+// appSnapshot defines an app in [snapshot]
+type appSnapshot struct {
+	AppID   string    `json:"app_id"`
+	LastUse time.Time `json:"last_use"`
+	Rate    float64   `json:"rate"` // requests per second
+}
+
+// appStats contains usage statistics of [DB]
+type appStats struct {
+	// Number of leases by [Mgr.DBContext] and time of the last one in unix
+	// nanoseconds. They are changed atomically and should be the first fields,
+	// because of alignment of 64-bit atomic operations.
+	uses    uint64
+	lastUse int64
+
+	// Changed under Mgr.statsMu only
+	rate     float64   // requests per second
+	rateUses uint64    // uses, when rate was updated
+	rateAt   time.Time // when rate was updated
+}
+
+// touch marks [DB] was leased one more time at now
+func (self *appStats) touch(now time.Time) {
+	atomic.AddUint64(&self.uses, 1)
+	atomic.StoreInt64(&self.lastUse, now.UnixNano())
+}
+
+// lastUseTime returns time of the last lease of [DB] or zero time, if it wasn't
+// leased.
+func (self *appStats) lastUseTime() time.Time {
+	if t := atomic.LoadInt64(&self.lastUse); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// updateRate updates request rate with uses since the last update. Weight of
+// these uses depends on time since the last update, so the rate doesn't depend
+// on how often it's updated. Should be called under Mgr.statsMu.
+func (self *appStats) updateRate(now time.Time) {
+	uses := atomic.LoadUint64(&self.uses)
+	if elapsed := now.Sub(self.rateAt); elapsed > 0 {
+		cur := float64(uses-self.rateUses) / elapsed.Seconds()
+		weight := 1 - math.Exp(-float64(elapsed)/float64(rateWindow))
+		self.rate = weight*cur + (1-weight)*self.rate
+	}
+	self.rateUses = uses
+	self.rateAt = now
+}
+
+// loadSnapshot loads apps from [Config.SnapshotFile], if it's defined, so we
+// know hot apps before the restart. Missing file isn't an error. Returns error
+// if any or nil.
+func (self *Mgr) loadSnapshot() error {
+	if self.dbConfig.SnapshotFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(self.dbConfig.SnapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	now := self.clock.Now()
+	self.statsMu.Lock()
+	defer self.statsMu.Unlock()
+	for _, app := range snap.Apps {
+		if app.AppID != "" && now.Sub(app.LastUse) < snapshotMaxAge {
+			self.history[app.AppID] = app
+		}
+	}
+	return nil
+}
+
+// initStats initializes statistics of just opened db from loaded snapshot, if
+// it has db's app.
+func (self *Mgr) initStats(db *DB) {
+	self.statsMu.Lock()
+	defer self.statsMu.Unlock()
+
+	db.stats.rateAt = self.clock.Now()
+	if app, ok := self.history[db.AppID()]; ok {
+		db.stats.rate = app.Rate
+		if !app.LastUse.IsZero() {
+			atomic.StoreInt64(&db.stats.lastUse, app.LastUse.UnixNano())
+		}
+		delete(self.history, db.AppID())
+	}
+}
+
+// hotApps returns statistics of active and idle apps and apps from loaded
+// snapshot, which weren't opened yet, ordered by request rate from hottest to
+// coldest. It updates request rates of active and idle apps.
+func (self *Mgr) hotApps() []appSnapshot {
+	var dbs []*DB
+	self.eachActive(func(db *DB) { dbs = append(dbs, db) })
+	self.idle.each(func(db *DB) { dbs = append(dbs, db) })
+
+	now := self.clock.Now()
+	self.statsMu.Lock()
+	apps := make([]appSnapshot, 0, len(dbs)+len(self.history))
+	seen := make(map[string]struct{}, len(dbs))
+	for _, db := range dbs {
+		// the same app can be active and idle for a moment
+		if _, ok := seen[db.AppID()]; ok {
+			continue
+		}
+		seen[db.AppID()] = struct{}{}
+		db.stats.updateRate(now)
+		apps = append(apps, appSnapshot{
+			AppID:   db.AppID(),
+			LastUse: db.stats.lastUseTime(),
+			Rate:    db.stats.rate,
+		})
+	}
+	for appID, app := range self.history {
+		if _, ok := seen[appID]; !ok {
+			apps = append(apps, app)
+		}
+	}
+	self.statsMu.Unlock()
+
+	sortHot(apps)
+	return apps
+}
+
+// loadedApps returns apps from loaded snapshot, which pools weren't opened yet,
+// ordered from hottest to coldest.
+func (self *Mgr) loadedApps() []appSnapshot {
+	self.statsMu.Lock()
+	apps := make([]appSnapshot, 0, len(self.history))
+	for _, app := range self.history {
+		apps = append(apps, app)
+	}
+	self.statsMu.Unlock()
+
+	sortHot(apps)
+	return apps
+}
+
+// sortHot sorts apps by request rate from hottest to coldest. Apps with the
+// same rate are sorted from most to least recently used.
+func sortHot(apps []appSnapshot) {
+	sort.Slice(apps, func(i, j int) bool {
+		if apps[i].Rate != apps[j].Rate {
+			return apps[i].Rate > apps[j].Rate
+		}
+		return apps[i].LastUse.After(apps[j].LastUse)
+	})
+}
+
+// saveSnapshot writes hot apps into [Config.SnapshotFile], if it's defined.
+// Returns error if any or nil.
+func (self *Mgr) saveSnapshot() error {
+	if self.dbConfig.SnapshotFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(snapshot{
+		Saved: self.clock.Now(),
+		Apps:  self.hotApps(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(self.dbConfig.SnapshotFile, data)
+}
+
+// runSnapshots writes snapshot every [Config.SnapshotInterval], until stopCh
+// is closed.
+func (self *Mgr) runSnapshots(stopCh <-chan struct{}) {
+	interval := self.dbConfig.SnapshotInterval
+	if interval <= 0 {
+		interval = defSnapshotInterval
+	}
+	timer := self.clock.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			if err := self.saveSnapshot(); err != nil {
+				log.Printf("db: save snapshot: %v", err)
+			}
+			timer.Reset(interval)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// stopSnapshots stops saving of snapshots and waits for the last one. It's safe
+// to call it more than once.
+func (self *Mgr) stopSnapshots() {
+	self.snapStopOnce.Do(func() { close(self.snapStop) })
+	self.snapWG.Wait()
+}
+
+// writeFileAtomic writes data into file name. It writes temporary file in the
+// same dir first and renames it, so nobody reads partially written file.
+// Returns error if any or nil.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestSnapshot writes snapshot with apps into file name
+func writeTestSnapshot(t testing.TB, name string, apps []appSnapshot) {
+	data, err := json.Marshal(snapshot{Saved: time.Now(), Apps: apps})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+}
+
+// readTestSnapshot reads snapshot from file name and returns its apps
+func readTestSnapshot(t testing.TB, name string) []appSnapshot {
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	var snap snapshot
+	require.NoError(t, json.Unmarshal(data, &snap))
+	return snap.Apps
+}
+
+func TestAppStatsRate(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Now()
+	var stats appStats
+	stats.rateAt = now
+	a.True(stats.lastUseTime().IsZero())
+
+	for i := 0; i < 10; i++ {
+		stats.touch(now.Add(time.Duration(i) * time.Second))
+	}
+	a.True(stats.lastUseTime().Equal(now.Add(9 * time.Second)))
+
+	// 10 requests during the window
+	stats.updateRate(now.Add(rateWindow))
+	rate := (1 - 1/math.E) * 10 / rateWindow.Seconds()
+	a.InDelta(stats.rate, rate, 1e-9)
+	a.Equal(stats.rateUses, uint64(10))
+
+	// no requests during the next window
+	stats.updateRate(now.Add(2 * rateWindow))
+	a.InDelta(stats.rate, rate/math.E, 1e-9)
+
+	// frequency of updates doesn't matter
+	stats.updateRate(now.Add(2*rateWindow + time.Millisecond))
+	a.InDelta(stats.rate, rate/math.E, 1e-6)
+}
+
+func TestSnapshot(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	clock := newFakeClock()
+	now := clock.Now()
+	snapFile := filepath.Join(t.TempDir(), "snapshot")
+	writeTestSnapshot(t, snapFile, []appSnapshot{
+		{AppID: "demoa", LastUse: now.Add(-time.Hour), Rate: 2},
+		{AppID: "demob", LastUse: now.Add(-time.Minute), Rate: 1},
+		{AppID: "democ", LastUse: now.Add(-2 * snapshotMaxAge), Rate: 9},
+	})
+	m := newTestMgr(t, Config{
+		Driver:       "mysql",
+		HostRW:       "tcp(127.0.0.1)",
+		SnapshotFile: snapFile,
+		Clock:        clock,
+	})
+	a.Len(m.history, 2, "old app isn't forgotten")
+
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	db := lease.DB()
+	a.Equal(db.stats.rate, 2.0)
+	a.NotContains(m.history, "demoa")
+	lease.Release()
+
+	clock.Advance(time.Minute)
+	_, err = m.DB("demod")
+	r.NoError(err)
+	clock.Advance(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), closeWaitInterval)
+	defer cancel()
+	a.ErrorIs(m.Close(ctx), context.DeadlineExceeded)
+
+	apps := readTestSnapshot(t, snapFile)
+	r.Len(apps, 3)
+	a.Equal(apps[0].AppID, "demoa")
+	a.True(apps[0].LastUse.Equal(now), "last use of demoa")
+	a.Equal(apps[1].AppID, "demob")
+	a.Equal(apps[1].Rate, 1.0)
+	a.Equal(apps[2].AppID, "demod")
+	a.Positive(apps[2].Rate)
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	m := newTestMgr(t, Config{Driver: "mysql"})
+	a.NoError(m.loadSnapshot())
+
+	m.dbConfig.SnapshotFile = filepath.Join(t.TempDir(), "snapshot")
+	a.NoError(m.loadSnapshot(), "missing file")
+
+	r.NoError(os.WriteFile(m.dbConfig.SnapshotFile, []byte("{"), 0o644))
+	a.Error(m.loadSnapshot())
+	a.Empty(m.history)
+}
+
+func TestRunSnapshots(t *testing.T) {
+	a := assert.New(t)
+
+	clock := newFakeClock()
+	snapFile := filepath.Join(t.TempDir(), "snapshot")
+	m := newTestMgr(t, Config{
+		Driver:           "mysql",
+		HostRW:           "tcp(127.0.0.1)",
+		SnapshotFile:     snapFile,
+		SnapshotInterval: time.Minute,
+		Clock:            clock,
+	})
+	defer m.Close(context.Background())
+
+	lease, err := m.DB("demoa")
+	require.NoError(t, err)
+	lease.Release()
+
+	// timers of snapshots and idle DB
+	clock.waitTimers(t, 2)
+	_, err = os.Stat(snapFile)
+	a.ErrorIs(err, os.ErrNotExist)
+	clock.Advance(time.Minute)
+	a.Eventually(func() bool {
+		data, err := os.ReadFile(snapFile)
+		return err == nil && json.Valid(data) &&
+			len(readTestSnapshot(t, snapFile)) == 1
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// Default number of ready connections of every pool after warm-up, see
+	// [Config.WarmConns].
+	defWarmConns = 1
+
+	// Number of apps, which are warmed up at the same time
+	warmWorkers = 4
+)
+
+// WarmApps returns list of apps, which should be warmed up by [Mgr.WarmUp]:
+// [Config.WarmApps] and apps from snapshot loaded from [Config.SnapshotFile],
+// which pools aren't open yet, from hottest to coldest one, without duplicates.
+func (self *Mgr) WarmApps() []string {
+	hot := self.loadedApps()
+	apps := make([]string, 0, len(self.dbConfig.WarmApps)+len(hot))
+	seen := make(map[string]struct{}, cap(apps))
+	add := func(appID string) {
+		if _, ok := seen[appID]; !ok {
+			seen[appID] = struct{}{}
+			apps = append(apps, appID)
+		}
+	}
+
+	for _, appID := range self.dbConfig.WarmApps {
+		add(appID)
+	}
+	for _, app := range hot {
+		add(app.AppID)
+	}
+	return apps
+}
+
+// WarmUp opens pools of apps with [Config.WarmConns] ready connections in every
+// pool and leaves them idle, so first requests of these apps don't wait for
+// connecting. If [Config.MaxIdleDBs] is defined, only so many first apps are
+// warmed up. It stops, when ctx is done, the global connection budget is
+// exhausted or [Mgr] is closed. Other errors of apps are logged. Warmed up
+// apps are ordered in the idle list by their last use time from snapshot, so
+// the least recently used ones are evicted first, like before restart. Returns
+// number of warmed up apps.
+func (self *Mgr) WarmUp(ctx context.Context, apps []string) int {
+	if maxIdle := self.dbConfig.MaxIdleDBs; maxIdle > 0 && len(apps) > maxIdle {
+		apps = apps[:maxIdle]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	appCh := make(chan string)
+	var warmed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for appID := range appCh {
+				switch err := self.warmApp(ctx, appID); {
+				case err == nil:
+					mu.Lock()
+					warmed++
+					mu.Unlock()
+				case errors.Is(err, ErrOverloaded), errors.Is(err, ErrClosed):
+					cancel()
+				case ctx.Err() == nil:
+					log.Printf("db: warm up %v: %v", appID, err)
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, appID := range apps {
+		select {
+		case appCh <- appID:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(appCh)
+	wg.Wait()
+	self.idle.sortByLastUse()
+
+	return warmed
+}
+
+// warmApp opens pools of appID, if they aren't open, with ready connections
+// and releases them. Warm-up isn't counted as use of appID, unlike
+// [Mgr.DBContext]. Returns error if any or nil.
+func (self *Mgr) warmApp(ctx context.Context, appID string) error {
+	lease, err := self.acquire(ctx, appID)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	return lease.DB().warm(ctx, self.dbConfig.WarmConns)
+}
+
+// warm opens n connections in every pool of this DB and returns them back into
+// pools as idle ones. Zero n means [defWarmConns]. Returns the first error, if
+// any, or nil.
+func (self *DB) warm(ctx context.Context, n int) error {
+	if n <= 0 {
+		n = defWarmConns
+	}
+
+	var firstErr error
+	if err := warmPool(ctx, self.dbRW, n); err != nil {
+		firstErr = err
+	}
+	for _, r := range self.dbRO {
+		if err := warmPool(ctx, r.db, n); err != nil {
+			r.fail(err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("replica %s: %w", r.host, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// warmPool opens n connections of pool, but no more than its max number of
+// open connections, and returns them back into pool. Returns error if any or
+// nil.
+func warmPool(ctx context.Context, pool *sqlx.DB, n int) error {
+	if maxOpen := pool.Stats().MaxOpenConnections; maxOpen > 0 && n > maxOpen {
+		n = maxOpen
+	}
+
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		c, err := pool.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// warmTestDriver is SQL driver, which counts opened connections per DSN
+type warmTestDriver struct {
+	conns map[string]int
+	mu    sync.Mutex
+}
+
+var warmDriver = &warmTestDriver{conns: make(map[string]int)}
+
+func init() {
+	sql.Register("warmtest", warmDriver)
+	RegisterDSNBuilder("warmtest", testDSN{})
+}
+
+func (self *warmTestDriver) Open(name string) (driver.Conn, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.conns[name]++
+	return warmTestConn{}, nil
+}
+
+func (self *warmTestDriver) reset() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.conns = make(map[string]int)
+}
+
+func (self *warmTestDriver) numConns(name string) int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.conns[name]
+}
+
+type warmTestConn struct{}
+
+func (warmTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (warmTestConn) Close() error { return nil }
+
+func (warmTestConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestWarmApps(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:   "mysql",
+		WarmApps: []string{"demoa", "demob"},
+	})
+	assert.Equal(m.WarmApps(), []string{"demoa", "demob"})
+
+	clock := newFakeClock()
+	now := clock.Now()
+	snapFile := filepath.Join(t.TempDir(), "snapshot")
+	writeTestSnapshot(t, snapFile, []appSnapshot{
+		{AppID: "democ", LastUse: now, Rate: 1},
+		{AppID: "demob", LastUse: now, Rate: 5},
+		{AppID: "demod", LastUse: now.Add(-time.Minute), Rate: 3},
+		{AppID: "demoe", LastUse: now, Rate: 3},
+	})
+	m = newTestMgr(t, Config{
+		Driver:       "mysql",
+		WarmApps:     []string{"demoa", "demob"},
+		SnapshotFile: snapFile,
+		Clock:        clock,
+	})
+	defer m.Close(context.Background())
+	assert.Equal(m.WarmApps(),
+		[]string{"demoa", "demob", "demoe", "demod", "democ"})
+}
+
+func TestWarmUp(t *testing.T) {
+	a := assert.New(t)
+	r := require.New(t)
+
+	warmDriver.reset()
+	m := newTestMgr(t, Config{
+		Driver:     "warmtest",
+		HostRW:     "warm1",
+		HostRO:     []string{"warm2"},
+		MaxIdleDBs: 2,
+		WarmConns:  2,
+	})
+
+	n := m.WarmUp(context.Background(), []string{"demoa", "demob", "democ"})
+	a.Equal(n, 2)
+	a.True(m.idle.onIdle("demoa"))
+	a.True(m.idle.onIdle("demob"))
+	a.False(m.idle.onIdle("democ"), "more than MaxIdleDBs warmed up")
+	a.Zero(m.numActive())
+
+	a.Equal(warmDriver.numConns("warm1/demoa"), 2)
+	a.Zero(atomic.LoadUint64(&m.idle.idleList.Front().Value.(*idleDB).db.stats.uses),
+		"warm-up is counted as use")
+	a.Equal(warmDriver.numConns("warm2/demob"), 2)
+	lease, err := m.DB("demoa")
+	r.NoError(err)
+	a.Equal(lease.DB().RW().Stats().Idle, 2)
+	lease.Release()
+}
+
+func TestWarmUpOverloaded(t *testing.T) {
+	a := assert.New(t)
+
+	m := newTestMgr(t, Config{
+		Driver:   "warmtest",
+		HostRW:   "warm1",
+		MaxConns: 1,
+	})
+	lease, err := m.DB("demoa")
+	require.NoError(t, err)
+	defer lease.Release()
+
+	n := m.WarmUp(context.Background(), []string{"demob", "democ"})
+	a.Zero(n)
+	a.False(m.idle.onIdle("demob"))
+}
+
+func TestWarmUpClosed(t *testing.T) {
+	a := assert.New(t)
+
+	var logBuf safeBuffer
+	log.SetOutput(&logBuf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	m := newTestMgr(t, Config{Driver: "warmtest", HostRW: "warm1"})
+	a.NoError(m.Close(context.Background()))
+
+	n := m.WarmUp(context.Background(), []string{"demoa", "demob", "democ"})
+	a.Zero(n)
+	a.Zero(m.numActive())
+	a.Empty(logBuf.String())
+}
+
+func TestWarmUpLastUse(t *testing.T) {
+	a := assert.New(t)
+
+	clock := newFakeClock()
+	now := clock.Now()
+	snapFile := filepath.Join(t.TempDir(), "snapshot")
+	writeTestSnapshot(t, snapFile, []appSnapshot{
+		{AppID: "demoa", LastUse: now.Add(-time.Minute), Rate: 3},
+		{AppID: "demob", LastUse: now.Add(-time.Hour), Rate: 2},
+		{AppID: "democ", LastUse: now, Rate: 1},
+	})
+	m := newTestMgr(t, Config{
+		Driver:       "warmtest",
+		HostRW:       "warm1",
+		MaxIdleDBs:   3,
+		SnapshotFile: snapFile,
+		Clock:        clock,
+	})
+	defer m.Close(context.Background())
+
+	apps := m.WarmApps()
+	a.Equal(apps, []string{"demoa", "demob", "democ"})
+	a.Equal(m.WarmUp(context.Background(), apps), 3)
+	a.Empty(m.WarmApps())
+
+	// the least recently used app is evicted first, like before restart
+	var idle []string
+	m.idle.each(func(db *DB) { idle = append(idle, db.AppID()) })
+	a.Equal(idle, []string{"democ", "demoa", "demob"})
+	evicted, err := m.idle.evictOldest()
+	a.NoError(err)
+	a.Equal(evicted.AppID(), "demob")
+}
@@ -43,19 +43,50 @@ func init() {
 }
 
 func main() {
+	global, err := app.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// The HTTP Server
 	server := &http.Server{
 		Addr:    os.Getenv("HOST_ADDR"),
-		Handler: router.New(app.New()),
+		Handler: router.New(global),
+	}
+
+	// The optional admin HTTP Server on ADMIN_ADDR, like "127.0.0.1:5001". Its
+	// endpoints aren't protected, so it shouldn't be reachable from internet.
+	var adminServer *http.Server
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		adminServer = &http.Server{
+			Addr:    addr,
+			Handler: router.NewAdmin(global),
+		}
 	}
 
 	// Server run context
 	serverCtx, serverStopCtx := context.WithCancel(context.Background())
 
+	// Warm-up context, it's cancelled on shutdown before DB pools are closed
+	warmCtx, warmCancel := context.WithCancel(serverCtx)
+	warmDone := make(chan struct{})
+
+	// Reload global state on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := global.Reload(); err != nil {
+				log.Printf("reload: %v", err)
+			} else {
+				log.Print("reloaded")
+			}
+		}
+	}()
+
 	// Listen for syscall signals for process to interrupt/quit
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig,
-		syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-sig
 
@@ -76,12 +107,47 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if adminServer != nil {
+			if err := adminServer.Shutdown(shutdownCtx); err != nil {
+				log.Printf("admin shutdown: %v", err)
+			}
+		}
+
+		// Stop warm-up, so it doesn't acquire DB pools, while we close them
+		warmCancel()
+		select {
+		case <-warmDone:
+		case <-shutdownCtx.Done():
+		}
+
+		// Close DB pools after all requests are done
+		if err := global.Close(shutdownCtx); err != nil {
+			log.Printf("close: %v", err)
+		}
 		serverStopCtx()
 	}()
 
+	// Open DB pools of hot apps, /_ready reports ready after that
+	go func() {
+		defer close(warmDone)
+		warmed, total := global.WarmUp(warmCtx)
+		log.Printf("warmed up %d of %d apps", warmed, total)
+	}()
+
+	// Run the admin server
+	if adminServer != nil {
+		go func() {
+			log.Printf("Admin endpoints on %s", adminServer.Addr)
+			err := adminServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// Run the server
 	log.Printf("Ready to serve on %s", server.Addr)
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
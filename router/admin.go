@@ -0,0 +1,47 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"dsh/px/app"
+)
+
+// dbFailurePattern is URI of DB failures of an app. DELETE request clears
+// them, see [app.Global.ClearDBFailure].
+const dbFailurePattern = "/db/failures" + appIDPattern
+
+// NewAdmin creates and returns [*chi.Mux] router of admin endpoints for our
+// global application app. They aren't protected, so the router should be
+// served on a separate address, which is reachable from private network only,
+// see ADMIN_ADDR in main.go.
+func NewAdmin(app *app.Global) *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+
+	r.Delete(dbFailurePattern, clearDBFailure(app))
+	r.Get(debugLeasesPattern, debugLeases(app))
+
+	return r
+}
+
+// clearDBFailure returns handler, which clears DB failures of app from URI, so
+// its next request tries to open DB pools immediately. It writes 204, if the
+// app had failures, else it writes 404 problem document.
+func clearDBFailure(global *app.Global) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID := chi.URLParam(r, "appID")
+		if !global.ClearDBFailure(appID) {
+			writeError(w, r, app.NewError(app.ErrNotFound,
+				fmt.Sprintf("app %q has no DB failures", appID), nil))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
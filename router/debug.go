@@ -0,0 +1,56 @@
+package router
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"dsh/px/app"
+)
+
+// debugLeasesPattern is URI of the dump of outstanding DB leases. It's served
+// by admin router only, see [NewAdmin], because the dump contains stack traces
+// and IDs of requests.
+const debugLeasesPattern = "/_debug/leases"
+
+// leaseDump defines JSON item of the dump of outstanding DB leases
+type leaseDump struct {
+	Acquired  time.Time `json:"acquired"`
+	Held      string    `json:"held"`
+	Route     string    `json:"route,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Stack     string    `json:"stack"`
+}
+
+// debugLeases returns handler, which writes outstanding DB leases of global
+// per appID as JSON. If debug mode of leases is off, it writes 404 problem
+// document.
+func debugLeases(global *app.Global) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leases := global.DBLeases()
+		if leases == nil {
+			writeError(w, r, app.NewError(app.ErrNotFound,
+				"debug mode of leases is off", nil))
+			return
+		}
+
+		dump := make(map[string][]leaseDump, len(leases))
+		for appID, infos := range leases {
+			for _, info := range infos {
+				dump[appID] = append(dump[appID], leaseDump{
+					Acquired:  info.Acquired,
+					Held:      info.Held.String(),
+					Route:     info.Route,
+					RequestID: info.RequestID,
+					Stack:     info.Stack,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			log.Printf("write leases: %v", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"dsh/px/app"
+)
+
+// rwPinCookie is name of cookie, which keeps time until reads of a client are
+// pinned to RW server after its write. Value of the cookie is unix time in
+// milliseconds.
+const rwPinCookie = "px_rw_pin"
+
+// pinRWFromCookie pins reads of ctx to RW server, if request r has
+// [rwPinCookie].
+func pinRWFromCookie(ctx *app.Context, r *http.Request) {
+	c, err := r.Cookie(rwPinCookie)
+	if err != nil {
+		return
+	}
+	if ms, err := strconv.ParseInt(c.Value, 10, 64); err == nil {
+		ctx.PinRW(time.UnixMilli(ms))
+	}
+}
+
+// pinRWCookie returns function, which sets [rwPinCookie] for appID in w. The
+// cookie can be set only before the first write of response body.
+func pinRWCookie(w http.ResponseWriter, appID string) func(time.Time) {
+	return func(until time.Time) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     rwPinCookie,
+			Value:    strconv.FormatInt(until.UnixMilli(), 10),
+			Path:     "/" + appID,
+			Expires:  until,
+			HttpOnly: true,
+		})
+	}
+}
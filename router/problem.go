@@ -0,0 +1,99 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"dsh/px/app"
+)
+
+// problemContentType is media type of problem documents, see [RFC 7807].
+//
+// [RFC 7807]: https://www.rfc-editor.org/rfc/rfc7807
+const problemContentType = "application/problem+json"
+
+// statusClientClosed is non-standard HTTP status code of requests, which were
+// canceled by client, the same as in nginx. The client doesn't see it, but it
+// gets to access logs and metrics, and it isn't 5xx.
+const statusClientClosed = 499
+
+// problem defines JSON problem document from [RFC 7807], which we return to a
+// client in case of errors.
+//
+// [RFC 7807]: https://www.rfc-editor.org/rfc/rfc7807
+type problem struct {
+	// URI reference, which identifies the problem type. We always use
+	// "about:blank", so Title is the same as HTTP status text.
+	Type string `json:"type"`
+	// Short, human-readable summary of the problem type.
+	Title string `json:"title"`
+	// HTTP status code.
+	Status int `json:"status"`
+	// Human-readable explanation specific to this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// URI reference, which identifies this occurrence of the problem.
+	Instance string `json:"instance,omitempty"`
+	// ID of the request, generated by [middleware.RequestID].
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorStatus returns HTTP status code for err, depending on its kind.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, app.ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, app.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, app.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, app.ErrCanceled),
+		errors.Is(err, context.Canceled):
+		return statusClientClosed
+	}
+	return http.StatusInternalServerError
+}
+
+// statusText returns text of HTTP status code, including [statusClientClosed].
+func statusText(status int) string {
+	if status == statusClientClosed {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+// writeError writes err as a problem document into w. Only Detail of
+// [app.Error] is shown to the client, everything else is logged for 5xx
+// statuses.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	p := problem{
+		Type:      "about:blank",
+		Title:     statusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+
+	var appErr *app.Error
+	if errors.As(err, &appErr) {
+		p.Detail = appErr.Detail
+	}
+
+	if status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s: %v", p.RequestID, r.Method, r.URL.Path, err)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&p); err != nil {
+		log.Printf("[%s] write problem: %v", p.RequestID, err)
+	}
+}
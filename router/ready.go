@@ -0,0 +1,24 @@
+package router
+
+import (
+	"net/http"
+
+	"dsh/px/app"
+)
+
+// readyPattern is URI of readiness check. It isn't matched by [appIDPattern].
+const readyPattern = "/_ready"
+
+// ready returns handler of readiness check. It writes 200, when global is
+// ready to serve requests, see [app.Global.WarmUp], else it writes 503 problem
+// document.
+func ready(global *app.Global) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !global.Ready() {
+			writeError(w, r, app.NewError(app.ErrUnavailable,
+				"warming up", nil))
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
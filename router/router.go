@@ -2,6 +2,7 @@ package router
 
 import (
 	"dsh/px/app"
+	"dsh/px/db"
 
 	"fmt"
 	"net/http"
@@ -34,6 +35,7 @@ func NewWithRoutes(app *app.Global, subRoutes routesList) *chi.Mux {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
+	r.Get(readyPattern, ready(app))
 	r.Route(appIDPattern, func(r chi.Router) {
 		for _, v := range subRoutes {
 			r.Method(v.Method, v.Pattern, appHandler{app, v.Handler})
@@ -46,8 +48,12 @@ func NewWithRoutes(app *app.Global, subRoutes routesList) *chi.Mux {
 // handleFunc defines function, which process HTTP endpoint. See [1] for an
 // inspiration.
 //
+// It returns error if any or nil. If it returns an error, it shouldn't write
+// anything into [http.ResponseWriter], because the error will be written as
+// a problem document. Use [app.NewError] for errors with specific HTTP status.
+//
 // [1]: http://blog.questionable.services/article/custom-handlers-avoiding-globals/
-type handleFunc func(*app.Context, http.ResponseWriter, *http.Request)
+type handleFunc func(*app.Context, http.ResponseWriter, *http.Request) error
 
 // appHandler defines [http.Handler], which joins our global app and handleFn.
 type appHandler struct {
@@ -56,16 +62,37 @@ type appHandler struct {
 }
 
 // ServeHTTP process HTTP request. It extracts appID from URI, creates app
-// context for this appID and calls our handleFn with that context.
+// context for this appID and calls our handleFn with that context. The context
+// is closed after handleFn returned, even if it panics. Any error is written as
+// a problem document.
+//
+// Reads of a client are pinned to RW server after its write by cookie, so the
+// client reads its writes in next requests, see [rwPinCookie].
+//
+// Route and ID of the request are recorded for DB leases in debug mode, see
+// [db.WithLeaseTag].
 func (self appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	appID := chi.URLParam(r, "appID")
-	ctx, err := self.app.NewContext(appID)
+	reqCtx := db.WithLeaseTag(r.Context(), db.LeaseTag{
+		Route:     chi.RouteContext(r.Context()).RoutePattern(),
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	ctx, err := self.app.NewContext(reqCtx, appID)
 	if err != nil {
-		panic(err)
+		writeError(w, r, err)
+		return
+	}
+	defer ctx.Close()
+
+	pinRWFromCookie(ctx, r)
+	ctx.OnPinRW(pinRWCookie(w, appID))
+
+	if err := self.handleFn(ctx, w, r); err != nil {
+		writeError(w, r, err)
 	}
-	self.handleFn(ctx, w, r)
 }
 
-func hello(app *app.Context, w http.ResponseWriter, r *http.Request) {
+func hello(app *app.Context, w http.ResponseWriter, r *http.Request) error {
 	w.Write([]byte(fmt.Sprintf("Hello! AppID = %v", app.AppID())))
+	return nil
 }
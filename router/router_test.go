@@ -2,11 +2,16 @@ package router
 
 import (
 	"dsh/px/app"
+	"dsh/px/db"
 	"time"
 
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -79,9 +84,10 @@ func TestExtractAppID(t *testing.T) {
 		{
 			http.MethodHead,
 			rndURI,
-			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) {
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
 				appID = ctx.AppID()
 				w.Write([]byte(fmt.Sprintf("AppID = %v", appID)))
+				return nil
 			},
 		},
 	}
@@ -100,6 +106,128 @@ func TestExtractAppID(t *testing.T) {
 	assert.Equal(appID, wantAppID)
 }
 
+// Let's test how our appHandler writes errors returned by handlers.
+func TestAppHandlerError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rndURI := rndTestURI(t)
+	routes := routesList{
+		{
+			http.MethodGet,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				return app.NewError(app.ErrNotFound, "no such item", nil)
+			},
+		},
+	}
+
+	g := new(app.Global)
+	ts := httptest.NewServer(NewWithRoutes(g, routes))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Get(ts.URL + "/demoa" + rndURI)
+	require.NoError(err)
+	defer resp.Body.Close()
+
+	assert.Equal(resp.StatusCode, http.StatusNotFound)
+	assert.Equal(resp.Header.Get("Content-Type"), problemContentType)
+
+	var p problem
+	require.NoError(json.NewDecoder(resp.Body).Decode(&p))
+	assert.Equal(p.Type, "about:blank")
+	assert.Equal(p.Title, http.StatusText(http.StatusNotFound))
+	assert.Equal(p.Status, http.StatusNotFound)
+	assert.Equal(p.Detail, "no such item")
+	assert.Equal(p.Instance, "/demoa"+rndURI)
+	assert.NotEmpty(p.RequestID)
+}
+
+// Let's test how reads are pinned to RW server after a write by cookie.
+func TestPinRWCookie(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rndURI := rndTestURI(t)
+	var pinned bool
+	routes := routesList{
+		{
+			http.MethodPost,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				_, err := ctx.RW()
+				return err
+			},
+		},
+		{
+			http.MethodGet,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				pinned = ctx.PinnedRW()
+				return nil
+			},
+		},
+	}
+
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_HOST_RW", "tcp(127.0.0.1)")
+	t.Setenv("DB_RW_PIN", "1m")
+	g, err := app.New()
+	require.NoError(err)
+	ts := httptest.NewServer(NewWithRoutes(g, routes))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Post(ts.URL+"/demoa"+rndURI, "", nil)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(resp.StatusCode, http.StatusOK)
+
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == rwPinCookie {
+			cookie = c
+		}
+	}
+	require.NotNil(cookie, "no pinning cookie")
+	assert.Equal(cookie.Path, "/demoa")
+
+	resp, err = http.DefaultClient.Get(ts.URL + "/demoa" + rndURI)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.False(pinned, "pinned without cookie")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/demoa"+rndURI, nil)
+	require.NoError(err)
+	req.AddCookie(cookie)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.True(pinned, "not pinned with cookie")
+}
+
+func TestErrorStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{app.NewError(app.ErrNotFound, "", nil), http.StatusNotFound},
+		{app.NewError(app.ErrBadRequest, "", nil), http.StatusBadRequest},
+		{app.NewError(app.ErrUnavailable, "", nil), http.StatusServiceUnavailable},
+		{app.NewError(app.ErrTimeout, "", nil), http.StatusGatewayTimeout},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded),
+			http.StatusGatewayTimeout},
+		{app.NewError(app.ErrCanceled, "", nil), statusClientClosed},
+		{fmt.Errorf("query: %w", context.Canceled), statusClientClosed},
+		{errors.New("something"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(errorStatus(tt.err), tt.status, "%v", tt.err)
+	}
+}
+
 // rndTestURI returns random URI like "/test-RANDOMHEXSTRING".
 func rndTestURI(t *testing.T) string {
 	bytes := make([]byte, 8)
@@ -109,3 +237,204 @@ func rndTestURI(t *testing.T) string {
 	}
 	return "/test-" + hex.EncodeToString(bytes)
 }
+
+func TestDebugLeases(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_HOST_RW", "tcp(127.0.0.1)")
+	g, err := app.New()
+	require.NoError(err)
+	ts := httptest.NewServer(NewAdmin(g))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Get(ts.URL + debugLeasesPattern)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusNotFound)
+
+	t.Setenv("DB_LEASE_DEBUG", "true")
+	g, err = app.New()
+	require.NoError(err)
+
+	var dump map[string][]leaseDump
+	rndURI := rndTestURI(t)
+	routes := routesList{
+		{
+			http.MethodGet,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				if _, err := ctx.DB(); err != nil {
+					return err
+				}
+				rec := httptest.NewRecorder()
+				debugLeases(g)(rec, httptest.NewRequest(http.MethodGet,
+					debugLeasesPattern, nil))
+				return json.NewDecoder(rec.Body).Decode(&dump)
+			},
+		},
+	}
+	ts2 := httptest.NewServer(NewWithRoutes(g, routes))
+	defer ts2.Close()
+
+	resp, err = http.DefaultClient.Get(ts2.URL + "/demoa" + rndURI)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(resp.StatusCode, http.StatusOK)
+
+	require.Len(dump["demoa"], 1)
+	lease := dump["demoa"][0]
+	assert.Equal(lease.Route, appIDPattern+rndURI)
+	assert.NotEmpty(lease.RequestID)
+	assert.NotEmpty(lease.Stack)
+
+	// the dump isn't public
+	resp, err = http.DefaultClient.Get(ts2.URL + debugLeasesPattern)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusNotFound)
+
+	admin := httptest.NewServer(NewAdmin(g))
+	defer admin.Close()
+	resp, err = http.DefaultClient.Get(admin.URL + debugLeasesPattern)
+	require.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusOK)
+	dump = nil
+	require.NoError(json.NewDecoder(resp.Body).Decode(&dump))
+	assert.Empty(dump, "lease isn't released")
+}
+
+func TestReady(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_HOST_RW", "tcp(127.0.0.1)")
+	g, err := app.New()
+	require.NoError(err)
+	ts := httptest.NewServer(New(g))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Get(ts.URL + readyPattern)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusServiceUnavailable)
+
+	warmed, total := g.WarmUp(context.Background())
+	assert.Zero(warmed)
+	assert.Zero(total)
+
+	resp, err = http.DefaultClient.Get(ts.URL + readyPattern)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusOK)
+}
+
+func TestAdminClearDBFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	host := fmt.Sprintf("tcp(%s)", l.Addr())
+	require.NoError(l.Close())
+
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_HOST_RW", host)
+	t.Setenv("DB_PING_TIMEOUT", "1s")
+	t.Setenv("DB_FAILURE_BACKOFF", "1m")
+	g, err := app.New()
+	require.NoError(err)
+	defer g.Close(context.Background())
+
+	rndURI := rndTestURI(t)
+	routes := routesList{
+		{
+			http.MethodGet,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				_, err := ctx.DB()
+				return err
+			},
+		},
+	}
+	ts := httptest.NewServer(NewWithRoutes(g, routes))
+	defer ts.Close()
+	admin := httptest.NewServer(NewAdmin(g))
+	defer admin.Close()
+
+	clearFailure := func() int {
+		req, err := http.NewRequest(http.MethodDelete,
+			admin.URL+"/db/failures/demoa", nil)
+		require.NoError(err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(clearFailure(), http.StatusNotFound)
+
+	resp, err := http.DefaultClient.Get(ts.URL + "/demoa" + rndURI)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(resp.StatusCode, http.StatusServiceUnavailable)
+
+	assert.Equal(clearFailure(), http.StatusNoContent)
+	assert.Equal(clearFailure(), http.StatusNotFound)
+}
+
+// Let's test DB of the app is released, even if the handler panics.
+func TestAppHandlerPanic(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_HOST_RW", "tcp(127.0.0.1)")
+	t.Setenv("DB_LEASE_DEBUG", "true")
+	t.Setenv("DB_MAX_IDLE_APPS", "1")
+	g, err := app.New()
+	require.NoError(err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NoError(g.Close(ctx), "lease isn't released")
+	}()
+
+	var panicDB *db.DB
+	rndURI := rndTestURI(t)
+	routes := routesList{
+		{
+			http.MethodGet,
+			rndURI,
+			func(ctx *app.Context, w http.ResponseWriter, r *http.Request) error {
+				appDB, err := ctx.DB()
+				if err != nil {
+					return err
+				}
+				if ctx.AppID() == "demoa" {
+					panicDB = appDB
+					panic("test panic")
+				}
+				return nil
+			},
+		},
+	}
+	ts := httptest.NewServer(NewWithRoutes(g, routes))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Get(ts.URL + "/demoa" + rndURI)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusInternalServerError)
+	require.NotNil(panicDB)
+	assert.Empty(g.DBLeases(), "lease isn't released")
+
+	// idle DB of demoa is evicted by DB of demob
+	resp, err = http.DefaultClient.Get(ts.URL + "/demob" + rndURI)
+	require.NoError(err)
+	resp.Body.Close()
+	assert.Equal(resp.StatusCode, http.StatusOK)
+	assert.Nil(panicDB.RW(), "DB isn't idle")
+}